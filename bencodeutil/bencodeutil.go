@@ -0,0 +1,36 @@
+// Package bencodeutil holds helpers for working with bencoded data shared by
+// the tracker, peer wire, DHT and storage packages.
+package bencodeutil
+
+import (
+	"os"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Int returns a value decoded by bencode.Decode as an int, or 0 if it is not
+// an integer.
+func Int(value interface{}) int {
+	n, _ := value.(int64)
+	return int(n)
+}
+
+// WriteFile writes v bencoded to path. It writes to a temporary file first
+// and renames it into place, so a crash never leaves a torn file behind.
+func WriteFile(path string, v interface{}) error {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = bencode.Marshal(f, v)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
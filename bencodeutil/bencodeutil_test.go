@@ -0,0 +1,45 @@
+package bencodeutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInt(t *testing.T) {
+	tests := map[string]struct {
+		input  interface{}
+		output int
+	}{
+		"integer":     {input: int64(42), output: 42},
+		"negative":    {input: int64(-1), output: -1},
+		"string":      {input: "42", output: 0},
+		"missing key": {input: nil, output: 0},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.output, Int(test.input), name)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	require.Nil(t, os.WriteFile(path, []byte("old"), 0644))
+
+	err := WriteFile(path, map[string]interface{}{"a": 1})
+	assert.Nil(t, err)
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "d1:ai1ee", string(data))
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err), "the temporary file is renamed into place")
+
+	err = WriteFile(path, func() {})
+	assert.NotNil(t, err)
+	data, err = os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "d1:ai1ee", string(data), "a failed write leaves the file alone")
+}
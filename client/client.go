@@ -6,18 +6,41 @@ import (
 	"bittorrent_client/message"
 	"bittorrent_client/peers"
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// writeTimeout drops peers that stop reading what we send them.
+const writeTimeout = 30 * time.Second
+
+// RequestQueueLength is how many outstanding requests we accept from a peer,
+// advertised as reqq in our extended handshake.
+const RequestQueueLength = 250
+
 type Client struct {
 	Conn     net.Conn
 	Choked   bool
 	Bitfield bitfield.BitField
+	// Extended is the peer's extended handshake, nil until it arrives
+	Extended *ExtendedHandshake
 	peer     peers.Peer
 	infoHash [20]byte
 	peerID   [20]byte
+	// extensions is what we advertise in our extended handshake,
+	// LocalExtensions when nil
+	extensions map[string]uint8
+	// pending is a message read while waiting for the bitfield
+	pending *message.Message
+	// wmu keeps messages written from several goroutines from interleaving
+	wmu sync.Mutex
+	// unchoking and peerInterested are read by the choker while the
+	// connection's own goroutines change them
+	unchoking      atomic.Bool
+	peerInterested atomic.Bool
 }
 
 func completeHandshake(conn net.Conn, infoHash [20]byte, peerID [20]byte) (*handshake.Handshake, error) {
@@ -41,79 +64,236 @@ func completeHandshake(conn net.Conn, infoHash [20]byte, peerID [20]byte) (*hand
 	return res, nil
 }
 
-func recvBitfield(conn net.Conn) (bitfield.BitField, error) {
-	conn.SetDeadline(time.Now().Add(3 * time.Second))
-	defer conn.SetDeadline(time.Time{})
+// recvBitfield waits for the peer's bitfield, accepting the keep-alives and
+// extension protocol messages some peers send ahead of it. Peers without
+// pieces may skip the bitfield; when numBytes is known such peers get an empty
+// one instead of an error.
+func (client *Client) recvBitfield(numBytes int) error {
+	client.Conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer client.Conn.SetDeadline(time.Time{})
 
-	msg, err := message.Read(conn)
-	if err != nil {
-		return nil, err
+	for {
+		msg, err := message.Read(client.Conn)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && numBytes > 0 {
+			client.Bitfield = make(bitfield.BitField, numBytes)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			continue
+		}
+		switch msg.ID {
+		case message.MsgBitfield:
+			client.Bitfield = msg.Payload
+			return nil
+		case message.MsgExtended:
+			_, _, err = client.ReadExtended(msg)
+			if err != nil {
+				return err
+			}
+		default:
+			if numBytes == 0 {
+				return fmt.Errorf("expected bitfield but got ID %d", msg.ID)
+			}
+			client.Bitfield = make(bitfield.BitField, numBytes)
+			client.pending = msg
+			return nil
+		}
 	}
-	if msg.ID != message.MsgBitfield {
-		err := fmt.Errorf("expected bitfield but got ID %d", msg.ID)
-		return nil, err
+}
+
+// ReadMessage reads the next message, keeping track of whether the peer is
+// interested in us.
+func (client *Client) ReadMessage() (*message.Message, error) {
+	msg := client.pending
+	client.pending = nil
+	if msg == nil {
+		var err error
+		msg, err = message.Read(client.Conn)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return msg.Payload, nil
+	if msg != nil && msg.ID == message.MsgInterested {
+		client.peerInterested.Store(true)
+	} else if msg != nil && msg.ID == message.MsgNotInterested {
+		client.peerInterested.Store(false)
+	}
+	return msg, nil
 }
 
-func (client Client) ReadMessage() (*message.Message, error) {
-	msg, err := message.Read(client.Conn)
-	return msg, err
+// AmChoking reports whether we choke the peer, as every connection starts.
+func (client *Client) AmChoking() bool {
+	return !client.unchoking.Load()
 }
 
-func (client Client) SendUnchoke() error {
-	msg := message.Message{ID: message.MsgUnchoke}
-	_, err := client.Conn.Write(msg.Serialize())
-	return err
+// PeerInterested reports whether the peer wants pieces from us.
+func (client *Client) PeerInterested() bool {
+	return client.peerInterested.Load()
 }
 
-func (client Client) SendInterested() error {
-	msg := message.Message{ID: message.MsgInterested}
-	_, err := client.Conn.Write(msg.Serialize())
-	return err
+func (client *Client) Peer() peers.Peer {
+	return client.peer
 }
 
-func (client Client) SendNotInterested() error {
-	msg := message.Message{ID: message.MsgNotInterested}
+func (client *Client) send(msg *message.Message) error {
+	client.wmu.Lock()
+	defer client.wmu.Unlock()
+	client.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 	_, err := client.Conn.Write(msg.Serialize())
 	return err
 }
 
-func (client Client) SendHave(index int) error {
-	msg := message.FormatHave(index)
-	_, err := client.Conn.Write(msg.Serialize())
-	return err
+func (client *Client) SendChoke() error {
+	client.unchoking.Store(false)
+	return client.send(&message.Message{ID: message.MsgChoke})
 }
 
-func (client Client) SendRequest(index, begin, length int) error {
-	req := message.FormatRequest(index, begin, length)
-	_, err := client.Conn.Write(req.Serialize())
-	return err
+func (client *Client) SendUnchoke() error {
+	client.unchoking.Store(true)
+	return client.send(&message.Message{ID: message.MsgUnchoke})
 }
 
-func ConnectWithPeer(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+func (client *Client) SendInterested() error {
+	return client.send(&message.Message{ID: message.MsgInterested})
+}
+
+func (client *Client) SendNotInterested() error {
+	return client.send(&message.Message{ID: message.MsgNotInterested})
+}
+
+func (client *Client) SendHave(index int) error {
+	return client.send(message.FormatHave(index))
+}
+
+func (client *Client) SendBitfield(bf bitfield.BitField) error {
+	return client.send(&message.Message{ID: message.MsgBitfield, Payload: bf})
+}
+
+func (client *Client) SendRequest(index, begin, length int) error {
+	return client.send(message.FormatRequest(index, begin, length))
+}
+
+func (client *Client) SendCancel(index, begin, length int) error {
+	return client.send(message.FormatCancel(index, begin, length))
+}
+
+func (client *Client) SendPiece(index, begin int, block []byte) error {
+	return client.send(message.FormatPiece(index, begin, block))
+}
+
+// ConnectWithPeer dials the peer and exchanges handshakes and bitfields. bf
+// holds the pieces we have; with a nil bf no bitfield is sent and the peer
+// must send one.
+func ConnectWithPeer(peer peers.Peer, peerID, infoHash [20]byte, bf bitfield.BitField) (*Client, error) {
+	client, _, err := dial(peer, peerID, infoHash, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = completeHandshake(conn, infoHash, peerID)
+	if bf != nil {
+		err = client.SendBitfield(bf)
+		if err != nil {
+			client.Conn.Close()
+			return nil, err
+		}
+	}
+
+	err = client.recvBitfield(len(bf))
 	if err != nil {
+		client.Conn.Close()
 		return nil, err
 	}
+	return client, nil
+}
 
-	bf, err := recvBitfield(conn)
+// DialExtended dials the peer to talk to it over the extension protocol only,
+// advertising extensions instead of LocalExtensions. No bitfields are
+// exchanged; the peer's is read past like any other message.
+func DialExtended(peer peers.Peer, peerID, infoHash [20]byte, extensions map[string]uint8) (*Client, error) {
+	client, extended, err := dial(peer, peerID, infoHash, extensions)
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
+	if !extended {
+		client.Conn.Close()
+		return nil, fmt.Errorf("peer does not support the extension protocol")
+	}
+	return client, nil
+}
+
+// dial connects to the peer, exchanges handshakes and sends our extended
+// handshake if the peer supports the extension protocol, which extended
+// reports.
+func dial(peer peers.Peer, peerID, infoHash [20]byte, extensions map[string]uint8) (client *Client, extended bool, err error) {
+	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+	if err != nil {
+		return nil, false, err
+	}
+
+	res, err := completeHandshake(conn, infoHash, peerID)
+	if err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+
+	client = &Client{
+		Conn:       conn,
+		Choked:     true,
+		peer:       peer,
+		infoHash:   infoHash,
+		peerID:     peerID,
+		extensions: extensions,
+	}
+	extended = res.HasFlag(handshake.FlagExtensionProtocol)
+	if extended {
+		err = client.sendExtendedHandshake()
+		if err != nil {
+			conn.Close()
+			return nil, false, err
+		}
+	}
+	return client, extended, nil
+}
+
+// Accept completes a connection the peer opened, after its handshake was read
+// as theirs. It answers with our handshake and bitfield and waits for the
+// peer's bitfield.
+func Accept(conn net.Conn, theirs *handshake.Handshake, peerID [20]byte, bf bitfield.BitField) (*Client, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{})
 
-	return &Client{
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected remote address %s", conn.RemoteAddr())
+	}
+	client := &Client{
 		Conn:     conn,
 		Choked:   true,
-		Bitfield: bf,
-		peer:     peer,
-		infoHash: infoHash,
+		peer:     peers.Peer{IP: addr.IP, Port: uint16(addr.Port)},
+		infoHash: theirs.InfoHash,
 		peerID:   peerID,
-	}, nil
+	}
+	_, err := conn.Write(handshake.New(theirs.InfoHash, peerID).Serialize())
+	if err != nil {
+		return nil, err
+	}
+	if theirs.HasFlag(handshake.FlagExtensionProtocol) {
+		err = client.sendExtendedHandshake()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = client.SendBitfield(bf)
+	if err != nil {
+		return nil, err
+	}
+	err = client.recvBitfield(len(bf))
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
 }
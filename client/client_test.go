@@ -4,6 +4,8 @@ import (
 	"bittorrent_client/bitfield"
 	"bittorrent_client/handshake"
 	"bittorrent_client/message"
+	"bittorrent_client/peers"
+	"io"
 	"net"
 	"testing"
 
@@ -46,19 +48,35 @@ func TestRecvBitfield(t *testing.T) {
 			output: nil,
 			fails:  true,
 		},
+		"keep-alive before bitfield": {
+			msg:    []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 5, 7},
+			output: bitfield.BitField{7},
+			fails:  false,
+		},
+		"extended handshake before bitfield": {
+			msg:    append(message.FormatExtended(0, []byte("d1:md6:ut_pexi2eee")).Serialize(), 0x00, 0x00, 0x00, 0x02, 5, 7),
+			output: bitfield.BitField{7},
+			fails:  false,
+		},
+		"malformed extended handshake": {
+			msg:    message.FormatExtended(0, []byte("li1ee")).Serialize(),
+			output: nil,
+			fails:  true,
+		},
 	}
 
 	for _, test := range tests {
 		clientConn, serverConn := createClientAndServer(t)
 		serverConn.Write(test.msg)
 
-		bf, err := recvBitfield(clientConn)
+		client := &Client{Conn: clientConn}
+		err := client.recvBitfield(0)
 
 		if test.fails {
 			assert.NotNil(t, err)
 		} else {
 			assert.Nil(t, err)
-			assert.Equal(t, bf, test.output)
+			assert.Equal(t, test.output, client.Bitfield)
 		}
 	}
 }
@@ -127,6 +145,24 @@ func TestRead(t *testing.T) {
 	assert.Equal(t, expected, msg)
 }
 
+func TestReadTracksInterest(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn}
+	assert.False(t, client.PeerInterested())
+
+	_, err := serverConn.Write((&message.Message{ID: message.MsgInterested}).Serialize())
+	require.Nil(t, err)
+	_, err = client.ReadMessage()
+	require.Nil(t, err)
+	assert.True(t, client.PeerInterested())
+
+	_, err = serverConn.Write((&message.Message{ID: message.MsgNotInterested}).Serialize())
+	require.Nil(t, err)
+	_, err = client.ReadMessage()
+	require.Nil(t, err)
+	assert.False(t, client.PeerInterested())
+}
+
 func TestSendRequest(t *testing.T) {
 	clientConn, serverConn := createClientAndServer(t)
 	client := Client{Conn: clientConn}
@@ -175,11 +211,32 @@ func TestSendNotInterested(t *testing.T) {
 	assert.Equal(t, expected, buf)
 }
 
+func TestSendChoke(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn}
+	client.SendUnchoke()
+	err := client.SendChoke()
+	assert.Nil(t, err)
+	assert.True(t, client.AmChoking())
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x01,
+		1,
+		0x00, 0x00, 0x00, 0x01,
+		0,
+	}
+	buf := make([]byte, len(expected))
+	_, err = io.ReadFull(serverConn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
 func TestSendUnchoke(t *testing.T) {
 	clientConn, serverConn := createClientAndServer(t)
 	client := Client{Conn: clientConn}
+	assert.True(t, client.AmChoking())
 	err := client.SendUnchoke()
 	assert.Nil(t, err)
+	assert.False(t, client.AmChoking())
 	expected := []byte{
 		0x00, 0x00, 0x00, 0x01,
 		1,
@@ -205,3 +262,286 @@ func TestSendHave(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, expected, buf)
 }
+
+func TestSendCancel(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn}
+	err := client.SendCancel(1, 2, 3)
+	assert.Nil(t, err)
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x0d,
+		8,
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x03,
+	}
+	buf := make([]byte, len(expected))
+	_, err = serverConn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
+func TestSendPiece(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn}
+	err := client.SendPiece(1, 2, []byte{0xaa, 0xbb})
+	assert.Nil(t, err)
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x0b,
+		7,
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x02,
+		0xaa, 0xbb,
+	}
+	buf := make([]byte, len(expected))
+	_, err = serverConn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
+func TestConnectWithPeerSendsBitfield(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+	received := make(chan *message.Message, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, err = handshake.Read(conn)
+		if err != nil {
+			return
+		}
+		// a handshake without the extension bit, so no extended handshake
+		res := handshake.New(infoHash, peerID)
+		res.Reserved = [8]byte{}
+		conn.Write(res.Serialize())
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		received <- msg
+		message.Read(conn) // stay silent until the client hangs up
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	peer := peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	c, err := ConnectWithPeer(peer, peerID, infoHash, bitfield.BitField{0xc0})
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	assert.Equal(t, bitfield.BitField{0x00}, c.Bitfield)
+	assert.Equal(t, &message.Message{ID: message.MsgBitfield, Payload: []byte{0xc0}}, <-received)
+}
+
+func TestConnectWithPeerIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback unavailable:", err)
+	}
+	defer ln.Close()
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, err = handshake.Read(conn)
+		if err != nil {
+			return
+		}
+		conn.Write(handshake.New(infoHash, peerID).Serialize())
+		bf := message.Message{ID: message.MsgBitfield, Payload: []byte{0xff}}
+		conn.Write(bf.Serialize())
+		message.Read(conn) // wait for the client to hang up
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	peer := peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	c, err := ConnectWithPeer(peer, peerID, infoHash, nil)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	assert.Equal(t, bitfield.BitField{0xff}, c.Bitfield)
+}
+
+func TestConnectWithPeerExtendedHandshake(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+	received := make(chan *ExtendedHandshake, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, err = handshake.Read(conn)
+		if err != nil {
+			return
+		}
+		conn.Write(handshake.New(infoHash, peerID).Serialize())
+		bf := message.Message{ID: message.MsgBitfield, Payload: []byte{0xff}}
+		conn.Write(bf.Serialize())
+		payload, _ := ExtendedHandshake{
+			Extensions: map[string]uint8{"ut_metadata": 3},
+			Version:    "Test 1.0",
+			ReqQ:       250,
+			YourIP:     net.IP{127, 0, 0, 1},
+		}.Serialize()
+		conn.Write(message.FormatExtended(0, payload).Serialize())
+
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		_, payload, _ = message.ParseExtended(msg)
+		h, _ := ParseExtendedHandshake(payload)
+		received <- h
+		message.Read(conn) // wait for the client to hang up
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	peer := peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	c, err := ConnectWithPeer(peer, peerID, infoHash, nil)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	assert.Equal(t, bitfield.BitField{0xff}, c.Bitfield)
+
+	// the extended handshake arrives after the bitfield, so it is picked up
+	// while reading messages
+	assert.False(t, c.SupportsExtension("ut_metadata"))
+	msg, err := c.ReadMessage()
+	require.Nil(t, err)
+	name, _, err := c.ReadExtended(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, "", name)
+	assert.True(t, c.SupportsExtension("ut_metadata"))
+	assert.Equal(t, &ExtendedHandshake{
+		Extensions: map[string]uint8{"ut_metadata": 3},
+		Version:    "Test 1.0",
+		ReqQ:       250,
+		YourIP:     net.IP{127, 0, 0, 1},
+	}, c.Extended)
+
+	ours := <-received
+	require.NotNil(t, ours)
+	assert.Equal(t, clientVersion, ours.Version)
+	assert.Equal(t, RequestQueueLength, ours.ReqQ)
+	assert.Equal(t, net.IP{127, 0, 0, 1}, ours.YourIP)
+}
+
+func TestAccept(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	tests := map[string]struct {
+		peerSends []byte
+		bitfield  bitfield.BitField
+		pending   *message.Message
+	}{
+		"peer sends its bitfield": {
+			peerSends: (&message.Message{ID: message.MsgBitfield, Payload: []byte{0xf0}}).Serialize(),
+			bitfield:  bitfield.BitField{0xf0},
+		},
+		"peer without pieces skips the bitfield": {
+			peerSends: message.FormatHave(2).Serialize(),
+			bitfield:  bitfield.BitField{0x00},
+			pending:   message.FormatHave(2),
+		},
+		"silent peer": {
+			peerSends: nil,
+			bitfield:  bitfield.BitField{0x00},
+		},
+	}
+
+	for name, test := range tests {
+		clientConn, serverConn := createClientAndServer(t)
+		theirs := handshake.New(infoHash, [20]byte{9})
+		serverConn.Write(test.peerSends)
+
+		c, err := Accept(clientConn, theirs, peerID, bitfield.BitField{0x80})
+		require.Nil(t, err, name)
+		assert.Equal(t, test.bitfield, c.Bitfield, name)
+		assert.Equal(t, clientConn.LocalAddr().String(), serverConn.RemoteAddr().String(), name)
+
+		// our side of the exchange: handshake, extended handshake, bitfield
+		ours, err := handshake.Read(serverConn)
+		require.Nil(t, err, name)
+		assert.Equal(t, infoHash, ours.InfoHash, name)
+		assert.Equal(t, peerID, ours.PeerID, name)
+		msg, err := message.Read(serverConn)
+		require.Nil(t, err, name)
+		assert.Equal(t, message.MsgExtended, msg.ID, name)
+		msg, err = message.Read(serverConn)
+		require.Nil(t, err, name)
+		assert.Equal(t, &message.Message{ID: message.MsgBitfield, Payload: []byte{0x80}}, msg, name)
+
+		if test.pending != nil {
+			msg, err = c.ReadMessage()
+			assert.Nil(t, err, name)
+			assert.Equal(t, test.pending, msg, name)
+		}
+		clientConn.Close()
+		serverConn.Close()
+	}
+}
+
+func TestDialExtended(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+	received := make(chan *message.Message, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, err = handshake.Read(conn)
+		if err != nil {
+			return
+		}
+		conn.Write(handshake.New(infoHash, peerID).Serialize())
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		received <- msg
+		conn.Write(message.FormatExtended(4, []byte("de")).Serialize())
+		message.Read(conn) // wait for the client to hang up
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	peer := peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	c, err := DialExtended(peer, peerID, infoHash, map[string]uint8{"ut_metadata": 4})
+	require.Nil(t, err)
+	defer c.Conn.Close()
+
+	// no bitfield is sent, the extended handshake comes first
+	msg := <-received
+	extendedID, payload, err := message.ParseExtended(msg)
+	require.Nil(t, err)
+	assert.Equal(t, uint8(0), extendedID)
+	h, err := ParseExtendedHandshake(payload)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]uint8{"ut_metadata": 4}, h.Extensions)
+
+	msg, err = c.ReadMessage()
+	require.Nil(t, err)
+	name, payload, err := c.ReadExtended(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, "ut_metadata", name)
+	assert.Equal(t, []byte("de"), payload)
+}
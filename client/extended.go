@@ -0,0 +1,160 @@
+package client
+
+import (
+	"bittorrent_client/bencodeutil"
+	"bittorrent_client/message"
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// clientVersion is sent as v in our extended handshake.
+const clientVersion = "bittorrent_client 0.1"
+
+// LocalExtensions maps the extensions we understand to the extended message
+// IDs peers should use when sending them to us.
+var LocalExtensions = map[string]uint8{
+	"ut_pex": 1,
+}
+
+// ExtendedHandshake is the BEP 10 handshake, sent as extended message 0.
+type ExtendedHandshake struct {
+	// Extensions maps extension names to the message IDs the sender expects
+	// to receive them with.
+	Extensions   map[string]uint8
+	Version      string
+	ReqQ         int
+	YourIP       net.IP
+	Port         int
+	MetadataSize int
+}
+
+func (h ExtendedHandshake) Serialize() ([]byte, error) {
+	m := map[string]interface{}{}
+	for name, id := range h.Extensions {
+		m[name] = int(id)
+	}
+	dict := map[string]interface{}{"m": m}
+	if h.Version != "" {
+		dict["v"] = h.Version
+	}
+	if h.ReqQ > 0 {
+		dict["reqq"] = h.ReqQ
+	}
+	if ip4 := h.YourIP.To4(); ip4 != nil {
+		dict["yourip"] = string(ip4)
+	} else if len(h.YourIP) == net.IPv6len {
+		dict["yourip"] = string(h.YourIP)
+	}
+	if h.Port > 0 {
+		dict["p"] = h.Port
+	}
+	if h.MetadataSize > 0 {
+		dict["metadata_size"] = h.MetadataSize
+	}
+
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, dict)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("extended handshake is not a dictionary")
+	}
+
+	h := &ExtendedHandshake{Extensions: map[string]uint8{}}
+	m, _ := dict["m"].(map[string]interface{})
+	for name, value := range m {
+		// an ID of 0 means the extension is disabled
+		id, ok := value.(int64)
+		if ok && id > 0 && id <= 255 {
+			h.Extensions[name] = uint8(id)
+		}
+	}
+	h.Version, _ = dict["v"].(string)
+	h.ReqQ = bencodeutil.Int(dict["reqq"])
+	if yourIP, ok := dict["yourip"].(string); ok && (len(yourIP) == net.IPv4len || len(yourIP) == net.IPv6len) {
+		h.YourIP = net.IP(yourIP)
+	}
+	h.Port = bencodeutil.Int(dict["p"])
+	h.MetadataSize = bencodeutil.Int(dict["metadata_size"])
+	return h, nil
+}
+
+// localExtensions returns the extensions we advertise to the peer.
+func (client *Client) localExtensions() map[string]uint8 {
+	if client.extensions == nil {
+		return LocalExtensions
+	}
+	return client.extensions
+}
+
+// sendExtendedHandshake advertises our extensions and request queue length
+// and tells the peer the address we see it connecting from.
+func (client *Client) sendExtendedHandshake() error {
+	h := ExtendedHandshake{
+		Extensions: client.localExtensions(),
+		Version:    clientVersion,
+		ReqQ:       RequestQueueLength,
+		YourIP:     client.peer.IP,
+	}
+	payload, err := h.Serialize()
+	if err != nil {
+		return err
+	}
+	return client.send(message.FormatExtended(0, payload))
+}
+
+// SupportsExtension reports whether the peer's extended handshake listed name.
+func (client *Client) SupportsExtension(name string) bool {
+	if client.Extended == nil {
+		return false
+	}
+	_, ok := client.Extended.Extensions[name]
+	return ok
+}
+
+// SendExtended sends payload as a message of the named extension, using the
+// ID the peer asked for in its extended handshake.
+func (client *Client) SendExtended(name string, payload []byte) error {
+	if !client.SupportsExtension(name) {
+		return fmt.Errorf("peer does not support %s", name)
+	}
+	return client.send(message.FormatExtended(client.Extended.Extensions[name], payload))
+}
+
+// ReadExtended handles an extended message. The extended handshake is
+// recorded on the client, any other message is returned with the name of the
+// local extension it belongs to, or an empty name if we never advertised its
+// ID.
+func (client *Client) ReadExtended(msg *message.Message) (string, []byte, error) {
+	extendedID, payload, err := message.ParseExtended(msg)
+	if err != nil {
+		return "", nil, err
+	}
+	if extendedID == 0 {
+		h, err := ParseExtendedHandshake(payload)
+		if err != nil {
+			return "", nil, err
+		}
+		client.Extended = h
+		return "", nil, nil
+	}
+	for name, id := range client.localExtensions() {
+		if id == extendedID {
+			return name, payload, nil
+		}
+	}
+	return "", payload, nil
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"bittorrent_client/message"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtendedHandshakeSerialize(t *testing.T) {
+	tests := map[string]struct {
+		input  ExtendedHandshake
+		output string
+	}{
+		"empty": {
+			input:  ExtendedHandshake{},
+			output: "d1:mdee",
+		},
+		"all fields": {
+			input: ExtendedHandshake{
+				Extensions:   map[string]uint8{"ut_metadata": 1, "ut_pex": 2},
+				Version:      "Test 1.0",
+				ReqQ:         250,
+				YourIP:       net.IP{10, 0, 0, 1},
+				Port:         6881,
+				MetadataSize: 31235,
+			},
+			output: "d1:md11:ut_metadatai1e6:ut_pexi2ee13:metadata_sizei31235e1:pi6881e4:reqqi250e1:v8:Test 1.06:yourip4:\x0a\x00\x00\x01e",
+		},
+		"ipv6 yourip": {
+			input:  ExtendedHandshake{YourIP: net.ParseIP("2001:db8::1")},
+			output: "d1:mde6:yourip16:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01e",
+		},
+	}
+
+	for name, test := range tests {
+		buf, err := test.input.Serialize()
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, string(buf), name)
+	}
+}
+
+func TestParseExtendedHandshake(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output *ExtendedHandshake
+		fails  bool
+	}{
+		"all fields": {
+			input: "d1:md11:ut_metadatai3e6:ut_pexi0ee13:metadata_sizei31235e1:pi6881e4:reqqi250e1:v8:Test 1.06:yourip4:\x0a\x00\x00\x01e",
+			output: &ExtendedHandshake{
+				Extensions:   map[string]uint8{"ut_metadata": 3},
+				Version:      "Test 1.0",
+				ReqQ:         250,
+				YourIP:       net.IP{10, 0, 0, 1},
+				Port:         6881,
+				MetadataSize: 31235,
+			},
+			fails: false,
+		},
+		"ignores bad values": {
+			input:  "d1:md1:ai300e1:b3:onee6:yourip3:abce",
+			output: &ExtendedHandshake{Extensions: map[string]uint8{}},
+			fails:  false,
+		},
+		"not a dictionary": {
+			input:  "li1ee",
+			output: nil,
+			fails:  true,
+		},
+		"malformed": {
+			input:  "d1:m",
+			output: nil,
+			fails:  true,
+		},
+	}
+
+	for name, test := range tests {
+		h, err := ParseExtendedHandshake([]byte(test.input))
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, h, name)
+	}
+}
+
+func TestSendExtended(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn}
+	err := client.SendExtended("ut_pex", []byte("de"))
+	assert.NotNil(t, err)
+
+	client.Extended = &ExtendedHandshake{Extensions: map[string]uint8{"ut_pex": 7}}
+	err = client.SendExtended("ut_pex", []byte("de"))
+	require.Nil(t, err)
+	msg, err := message.Read(serverConn)
+	require.Nil(t, err)
+	assert.Equal(t, message.FormatExtended(7, []byte("de")), msg)
+}
+
+func TestReadExtended(t *testing.T) {
+	client := Client{}
+
+	name, payload, err := client.ReadExtended(message.FormatExtended(LocalExtensions["ut_pex"], []byte("de")))
+	assert.Nil(t, err)
+	assert.Equal(t, "ut_pex", name)
+	assert.Equal(t, []byte("de"), payload)
+
+	name, _, err = client.ReadExtended(message.FormatExtended(9, []byte("de")))
+	assert.Nil(t, err)
+	assert.Equal(t, "", name)
+
+	_, _, err = client.ReadExtended(&message.Message{ID: message.MsgHave})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,334 @@
+package dht
+
+import (
+	"bittorrent_client/bencodeutil"
+	"bittorrent_client/peers"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultBootstrapNodes are well known routers used to join the network.
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// queryTimeout bounds how long a single query waits for its response.
+var queryTimeout = 2 * time.Second
+
+type Config struct {
+	// Addr is the UDP address to listen on, such as ":6881"
+	Addr string
+	// ID is the node ID. A zero ID is replaced by the one saved in StatePath,
+	// or a random one.
+	ID             [20]byte
+	BootstrapNodes []string
+	// StatePath is where the routing table is kept between runs. Empty
+	// disables persistence.
+	StatePath string
+}
+
+// DHT is a node of the mainline DHT.
+type DHT struct {
+	conn      *net.UDPConn
+	id        [20]byte
+	table     *table
+	tokens    *tokens
+	store     *peerStore
+	bootstrap []string
+	statePath string
+
+	mu      sync.Mutex
+	pending map[string]chan krpcMsg
+	nextTx  uint16
+
+	closed chan struct{}
+	done   chan struct{}
+}
+
+func New(cfg Config) (*DHT, error) {
+	addr, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var saved state
+	if cfg.StatePath != "" {
+		saved, err = loadState(cfg.StatePath)
+		if err != nil {
+			log.Println("Could not load DHT state:", err)
+		}
+	}
+	id := cfg.ID
+	if id == ([20]byte{}) {
+		id = saved.id
+	}
+	if id == ([20]byte{}) {
+		_, err = rand.Read(id[:])
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	d := &DHT{
+		conn:      conn,
+		id:        id,
+		table:     newTable(id),
+		tokens:    newTokens(),
+		store:     newPeerStore(),
+		bootstrap: cfg.BootstrapNodes,
+		statePath: cfg.StatePath,
+		pending:   map[string]chan krpcMsg{},
+		closed:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for _, n := range saved.nodes {
+		d.table.insert(n)
+	}
+	go d.serve()
+	return d, nil
+}
+
+func (d *DHT) ID() [20]byte {
+	return d.id
+}
+
+func (d *DHT) Addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Close saves the routing table and stops the node.
+func (d *DHT) Close() error {
+	select {
+	case <-d.closed:
+		return nil
+	default:
+	}
+	close(d.closed)
+	var err error
+	if d.statePath != "" {
+		err = saveState(d.statePath, d.id, d.table.nodes())
+	}
+	d.conn.Close()
+	<-d.done
+	return err
+}
+
+func (d *DHT) serve() {
+	defer close(d.done)
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-d.closed:
+				return
+			default:
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return
+		}
+		msg, err := decodeKRPC(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch msg.Y {
+		case "q":
+			d.handleQuery(addr, msg)
+		case "r", "e":
+			d.mu.Lock()
+			ch, ok := d.pending[msg.T]
+			delete(d.pending, msg.T)
+			d.mu.Unlock()
+			if ok {
+				ch <- msg
+			}
+		}
+	}
+}
+
+func (d *DHT) send(addr *net.UDPAddr, msg krpcMsg) error {
+	packet, err := msg.encode()
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteToUDP(packet, addr)
+	return err
+}
+
+// query sends a query to addr and waits for the response, adding the
+// responding node to the routing table.
+func (d *DHT) query(addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	args["id"] = string(d.id[:])
+	ch := make(chan krpcMsg, 1)
+	d.mu.Lock()
+	d.nextTx++
+	tx := string(binary.BigEndian.AppendUint16(nil, d.nextTx))
+	d.pending[tx] = ch
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, tx)
+		d.mu.Unlock()
+	}()
+
+	err := d.send(addr, krpcMsg{T: tx, Y: "q", Q: method, A: args})
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		if res.E != nil {
+			return nil, res.E
+		}
+		id, err := nodeID(res.R, "id")
+		if err != nil {
+			return nil, err
+		}
+		d.table.insert(node{id: id, addr: addr, lastSeen: time.Now()})
+		return res.R, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%s did not answer %s", addr, method)
+	case <-d.closed:
+		return nil, fmt.Errorf("dht closed")
+	}
+}
+
+func (d *DHT) handleQuery(addr *net.UDPAddr, msg krpcMsg) {
+	id, err := nodeID(msg.A, "id")
+	if err != nil {
+		d.sendError(addr, msg.T, errProtocol, err.Error())
+		return
+	}
+	d.table.insert(node{id: id, addr: addr, lastSeen: time.Now()})
+
+	res := map[string]interface{}{"id": string(d.id[:])}
+	switch msg.Q {
+	case "ping":
+	case "find_node":
+		target, err := nodeID(msg.A, "target")
+		if err != nil {
+			d.sendError(addr, msg.T, errProtocol, err.Error())
+			return
+		}
+		res["nodes"] = encodeNodes(d.table.closest(target, bucketSize))
+	case "get_peers":
+		infoHash, err := nodeID(msg.A, "info_hash")
+		if err != nil {
+			d.sendError(addr, msg.T, errProtocol, err.Error())
+			return
+		}
+		res["token"] = d.tokens.create(addr.IP)
+		if ps := d.store.get(infoHash, time.Now()); len(ps) > 0 {
+			res["values"] = encodeValues(ps)
+		} else {
+			res["nodes"] = encodeNodes(d.table.closest(infoHash, bucketSize))
+		}
+	case "announce_peer":
+		infoHash, err := nodeID(msg.A, "info_hash")
+		if err != nil {
+			d.sendError(addr, msg.T, errProtocol, err.Error())
+			return
+		}
+		token, _ := msg.A["token"].(string)
+		if !d.tokens.valid(token, addr.IP) {
+			d.sendError(addr, msg.T, errProtocol, "bad token")
+			return
+		}
+		port := bencodeutil.Int(msg.A["port"])
+		if bencodeutil.Int(msg.A["implied_port"]) != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			d.sendError(addr, msg.T, errProtocol, "bad port")
+			return
+		}
+		d.store.add(infoHash, peers.Peer{IP: addr.IP, Port: uint16(port)}, time.Now())
+	default:
+		d.sendError(addr, msg.T, errMethodUnknown, "Method Unknown")
+		return
+	}
+	d.send(addr, krpcMsg{T: msg.T, Y: "r", R: res})
+}
+
+func (d *DHT) sendError(addr *net.UDPAddr, tx string, code int, message string) {
+	d.send(addr, krpcMsg{T: tx, Y: "e", E: &KRPCError{Code: code, Message: message}})
+}
+
+// Bootstrap joins the network through the configured bootstrap nodes and
+// the nodes remembered from the last run, then looks up our own ID to fill
+// the routing table.
+func (d *DHT) Bootstrap() error {
+	var wg sync.WaitGroup
+	for _, host := range d.bootstrap {
+		addr, err := net.ResolveUDPAddr("udp", host)
+		if err != nil {
+			log.Printf("Could not resolve DHT bootstrap node %s: %v\n", host, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.query(addr, "find_node", map[string]interface{}{"target": string(d.id[:])})
+		}()
+	}
+	wg.Wait()
+	d.lookup(d.id, "find_node")
+	if d.table.len() == 0 {
+		return fmt.Errorf("could not reach any DHT node")
+	}
+	return nil
+}
+
+// GetPeers looks up peers for infoHash.
+func (d *DHT) GetPeers(infoHash [20]byte) ([]peers.Peer, error) {
+	res := d.lookup(infoHash, "get_peers")
+	if len(res.responded) == 0 {
+		return nil, fmt.Errorf("no DHT node answered")
+	}
+	return res.peers, nil
+}
+
+// Announce looks up peers for infoHash and tells the closest nodes that we
+// are downloading it on port.
+func (d *DHT) Announce(infoHash [20]byte, port uint16) ([]peers.Peer, error) {
+	res := d.lookup(infoHash, "get_peers")
+	if len(res.responded) == 0 {
+		return nil, fmt.Errorf("no DHT node answered")
+	}
+	var wg sync.WaitGroup
+	for _, n := range res.responded {
+		token, ok := res.tokens[n.id]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.query(n.addr, "announce_peer", map[string]interface{}{
+				"info_hash": string(infoHash[:]),
+				"port":      int(port),
+				"token":     token,
+			})
+		}()
+	}
+	wg.Wait()
+	return res.peers, nil
+}
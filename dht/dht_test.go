@@ -0,0 +1,119 @@
+package dht
+
+import (
+	"bittorrent_client/peers"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startNetwork starts n nodes on localhost that all bootstrap from the first.
+func startNetwork(t *testing.T, n int) []*DHT {
+	first, err := New(Config{Addr: "127.0.0.1:0"})
+	require.Nil(t, err)
+	t.Cleanup(func() { first.Close() })
+	nodes := []*DHT{first}
+	for range n - 1 {
+		d, err := New(Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{first.Addr().String()}})
+		require.Nil(t, err)
+		t.Cleanup(func() { d.Close() })
+		require.Nil(t, d.Bootstrap())
+		nodes = append(nodes, d)
+	}
+	return nodes
+}
+
+func TestBootstrapFillsTables(t *testing.T) {
+	nodes := startNetwork(t, 6)
+	for _, d := range nodes {
+		assert.Greater(t, d.table.len(), 1)
+	}
+	// the last node learned about the others through the first one
+	last := nodes[len(nodes)-1]
+	assert.Equal(t, len(nodes)-1, last.table.len())
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := startNetwork(t, 8)
+	infoHash := [20]byte{0xde, 0xe8, 0x6a, 0x7f}
+
+	ps, err := nodes[3].Announce(infoHash, 6881)
+	assert.Nil(t, err)
+	assert.Empty(t, ps)
+
+	ps, err = nodes[6].GetPeers(infoHash)
+	assert.Nil(t, err)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}}, dedup(ps))
+}
+
+func dedup(ps []peers.Peer) []peers.Peer {
+	seen := map[string]bool{}
+	var unique []peers.Peer
+	for _, peer := range ps {
+		if !seen[peer.String()] {
+			seen[peer.String()] = true
+			unique = append(unique, peer)
+		}
+	}
+	return unique
+}
+
+func TestAnnounceNeedsToken(t *testing.T) {
+	nodes := startNetwork(t, 2)
+	infoHash := [20]byte{1}
+	_, err := nodes[1].query(nodes[0].Addr(), "announce_peer", map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+		"port":      6881,
+		"token":     "forged",
+	})
+	var krpcErr *KRPCError
+	require.ErrorAs(t, err, &krpcErr)
+	assert.Equal(t, errProtocol, krpcErr.Code)
+	assert.Empty(t, nodes[0].store.get(infoHash, time.Now()))
+}
+
+func TestUnknownMethod(t *testing.T) {
+	nodes := startNetwork(t, 2)
+	_, err := nodes[1].query(nodes[0].Addr(), "vote", map[string]interface{}{})
+	var krpcErr *KRPCError
+	require.ErrorAs(t, err, &krpcErr)
+	assert.Equal(t, errMethodUnknown, krpcErr.Code)
+}
+
+func TestQueryTimeout(t *testing.T) {
+	queryTimeout = 100 * time.Millisecond
+	defer func() { queryTimeout = 2 * time.Second }()
+
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.Nil(t, err)
+	defer silent.Close()
+	d, err := New(Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{silent.LocalAddr().String()}})
+	require.Nil(t, err)
+	defer d.Close()
+
+	assert.NotNil(t, d.Bootstrap())
+}
+
+func TestStatePersistence(t *testing.T) {
+	nodes := startNetwork(t, 4)
+	statePath := filepath.Join(t.TempDir(), "dht", "state")
+
+	d, err := New(Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{nodes[0].Addr().String()}, StatePath: statePath})
+	require.Nil(t, err)
+	require.Nil(t, d.Bootstrap())
+	id := d.ID()
+	known := d.table.len()
+	require.Nil(t, d.Close())
+
+	// no bootstrap nodes this time, the saved table is enough
+	d, err = New(Config{Addr: "127.0.0.1:0", StatePath: statePath})
+	require.Nil(t, err)
+	defer d.Close()
+	assert.Equal(t, id, d.ID())
+	assert.Equal(t, known, d.table.len())
+	assert.Nil(t, d.Bootstrap())
+}
@@ -0,0 +1,179 @@
+package dht
+
+import (
+	"bittorrent_client/bencodeutil"
+	"bittorrent_client/peers"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// KRPC error codes
+const (
+	errGeneric       = 201
+	errServer        = 202
+	errProtocol      = 203
+	errMethodUnknown = 204
+)
+
+const compactNodeLen = 26 // 20 byte node ID followed by a compact IPv4 peer
+
+// krpcMsg is a decoded KRPC message. Queries carry Q and A, responses R, and
+// errors E.
+type krpcMsg struct {
+	T string
+	Y string
+	Q string
+	A map[string]interface{}
+	R map[string]interface{}
+	E *KRPCError
+}
+
+// KRPCError is an error a remote node answered a query with.
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("dht error %d: %s", e.Code, e.Message)
+}
+
+func (m krpcMsg) encode() ([]byte, error) {
+	dict := map[string]interface{}{"t": m.T, "y": m.Y}
+	switch m.Y {
+	case "q":
+		dict["q"] = m.Q
+		dict["a"] = m.A
+	case "r":
+		dict["r"] = m.R
+	case "e":
+		dict["e"] = []interface{}{m.E.Code, m.E.Message}
+	default:
+		return nil, fmt.Errorf("unknown KRPC message type %q", m.Y)
+	}
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, dict)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeKRPC(packet []byte) (krpcMsg, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(packet))
+	if err != nil {
+		return krpcMsg{}, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return krpcMsg{}, fmt.Errorf("KRPC message is not a dictionary")
+	}
+	var m krpcMsg
+	m.T, _ = dict["t"].(string)
+	m.Y, _ = dict["y"].(string)
+	switch m.Y {
+	case "q":
+		m.Q, _ = dict["q"].(string)
+		m.A, ok = dict["a"].(map[string]interface{})
+		if !ok || m.Q == "" {
+			return krpcMsg{}, fmt.Errorf("malformed KRPC query")
+		}
+	case "r":
+		m.R, ok = dict["r"].(map[string]interface{})
+		if !ok {
+			return krpcMsg{}, fmt.Errorf("malformed KRPC response")
+		}
+	case "e":
+		list, _ := dict["e"].([]interface{})
+		m.E = &KRPCError{Code: errGeneric}
+		if len(list) > 0 {
+			m.E.Code = bencodeutil.Int(list[0])
+		}
+		if len(list) > 1 {
+			m.E.Message, _ = list[1].(string)
+		}
+	default:
+		return krpcMsg{}, fmt.Errorf("unknown KRPC message type %q", m.Y)
+	}
+	return m, nil
+}
+
+// nodeID reads a 20 byte ID out of a KRPC argument or response dictionary.
+func nodeID(dict map[string]interface{}, key string) ([20]byte, error) {
+	var id [20]byte
+	s, ok := dict[key].(string)
+	if !ok || len(s) != len(id) {
+		return id, fmt.Errorf("missing or malformed %s", key)
+	}
+	copy(id[:], s)
+	return id, nil
+}
+
+func encodeNodes(nodes []node) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeLen)
+	for _, n := range nodes {
+		ip := n.addr.IP.To4()
+		if ip == nil {
+			continue // nodes6 is not supported
+		}
+		buf = append(buf, n.id[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n.addr.Port))
+	}
+	return string(buf)
+}
+
+func decodeNodes(encoded string) ([]node, error) {
+	if len(encoded)%compactNodeLen != 0 {
+		return nil, fmt.Errorf("received malformed nodes")
+	}
+	nodes := make([]node, 0, len(encoded)/compactNodeLen)
+	for offset := 0; offset < len(encoded); offset += compactNodeLen {
+		var n node
+		copy(n.id[:], encoded[offset:offset+20])
+		ip := net.IP([]byte(encoded[offset+20 : offset+24]))
+		port := binary.BigEndian.Uint16([]byte(encoded[offset+24 : offset+26]))
+		if port == 0 {
+			continue
+		}
+		n.addr = &net.UDPAddr{IP: ip, Port: int(port)}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// decodeValues parses the list of compact peers in a get_peers response.
+func decodeValues(list []interface{}) []peers.Peer {
+	var ps []peers.Peer
+	for _, value := range list {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var decoded []peers.Peer
+		switch len(s) {
+		case net.IPv4len + 2:
+			decoded, _ = peers.GetPeers([]byte(s))
+		case net.IPv6len + 2:
+			decoded, _ = peers.GetPeers6([]byte(s))
+		}
+		ps = append(ps, decoded...)
+	}
+	return ps
+}
+
+func encodeValues(ps []peers.Peer) []interface{} {
+	values := make([]interface{}, 0, len(ps))
+	for _, peer := range ps {
+		encoded := peers.EncodePeers([]peers.Peer{peer})
+		if len(encoded) == 0 {
+			encoded = peers.EncodePeers6([]peers.Peer{peer})
+		}
+		values = append(values, string(encoded))
+	}
+	return values
+}
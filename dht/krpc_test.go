@@ -0,0 +1,81 @@
+package dht
+
+import (
+	"bittorrent_client/peers"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKRPCRoundTrip(t *testing.T) {
+	tests := map[string]struct {
+		msg    krpcMsg
+		output string
+	}{
+		"query": {
+			msg:    krpcMsg{T: "aa", Y: "q", Q: "ping", A: map[string]interface{}{"id": "abcdefghij0123456789"}},
+			output: "d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe",
+		},
+		"response": {
+			msg:    krpcMsg{T: "aa", Y: "r", R: map[string]interface{}{"id": "mnopqrstuvwxyz123456"}},
+			output: "d1:rd2:id20:mnopqrstuvwxyz123456e1:t2:aa1:y1:re",
+		},
+		"error": {
+			msg:    krpcMsg{T: "aa", Y: "e", E: &KRPCError{Code: errGeneric, Message: "A Generic Error Ocurred"}},
+			output: "d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee",
+		},
+	}
+
+	for name, test := range tests {
+		encoded, err := test.msg.encode()
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, string(encoded), name)
+
+		decoded, err := decodeKRPC(encoded)
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.msg.T, decoded.T, name)
+		assert.Equal(t, test.msg.Y, decoded.Y, name)
+		assert.Equal(t, test.msg.Q, decoded.Q, name)
+		assert.Equal(t, test.msg.E, decoded.E, name)
+	}
+}
+
+func TestDecodeKRPCMalformed(t *testing.T) {
+	tests := map[string]string{
+		"not bencoded":       "garbage",
+		"not a dictionary":   "li1ee",
+		"unknown type":       "d1:t2:aa1:y1:xe",
+		"query without args": "d1:q4:ping1:t2:aa1:y1:qe",
+		"response without r": "d1:t2:aa1:y1:re",
+	}
+	for name, input := range tests {
+		_, err := decodeKRPC([]byte(input))
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestNodesRoundTrip(t *testing.T) {
+	nodes := []node{
+		{id: [20]byte{1}, addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 6881}},
+		{id: [20]byte{2}, addr: &net.UDPAddr{IP: net.IP{10, 0, 0, 2}, Port: 51413}},
+	}
+	encoded := encodeNodes(nodes)
+	assert.Len(t, encoded, 2*compactNodeLen)
+
+	decoded, err := decodeNodes(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, nodes, decoded)
+
+	_, err = decodeNodes(encoded[:30])
+	assert.NotNil(t, err)
+}
+
+func TestValuesRoundTrip(t *testing.T) {
+	ps := []peers.Peer{
+		{IP: net.IP{127, 0, 0, 1}, Port: 6881},
+		{IP: net.ParseIP("2001:db8::1"), Port: 6882},
+	}
+	assert.Equal(t, ps, decodeValues(encodeValues(ps)))
+	assert.Empty(t, decodeValues([]interface{}{"short", int64(3)}))
+}
@@ -0,0 +1,115 @@
+package dht
+
+import (
+	"bittorrent_client/peers"
+	"sort"
+	"sync"
+)
+
+// alpha is how many queries a lookup keeps in flight.
+const alpha = 3
+
+type lookupResult struct {
+	// responded holds the closest nodes that answered, nearest first
+	responded []node
+	tokens    map[[20]byte]string
+	peers     []peers.Peer
+}
+
+// lookup walks towards target, querying the closest nodes it knows about
+// until the bucketSize closest have all been asked. method is find_node or
+// get_peers.
+func (d *DHT) lookup(target [20]byte, method string) lookupResult {
+	key := "target"
+	if method == "get_peers" {
+		key = "info_hash"
+	}
+	res := lookupResult{tokens: map[[20]byte]string{}}
+	seenPeers := map[string]bool{}
+	candidates := d.table.closest(target, bucketSize)
+	queried := map[[20]byte]bool{}
+
+	for {
+		sort.Slice(candidates, func(i, j int) bool { return closer(target, candidates[i].id, candidates[j].id) })
+		var batch []node
+		for _, n := range candidates[:min(bucketSize, len(candidates))] {
+			if !queried[n.id] && len(batch) < alpha {
+				batch = append(batch, n)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		var failed [][20]byte
+		for _, n := range batch {
+			queried[n.id] = true
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r, err := d.query(n.addr, method, map[string]interface{}{key: string(target[:])})
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					d.table.failed(n.id)
+					failed = append(failed, n.id)
+					return
+				}
+				res.responded = append(res.responded, n)
+				if token, ok := r["token"].(string); ok {
+					res.tokens[n.id] = token
+				}
+				values, _ := r["values"].([]interface{})
+				for _, peer := range decodeValues(values) {
+					if !seenPeers[peer.String()] {
+						seenPeers[peer.String()] = true
+						res.peers = append(res.peers, peer)
+					}
+				}
+				encoded, _ := r["nodes"].(string)
+				found, _ := decodeNodes(encoded)
+				for _, f := range found {
+					if f.id != d.id && !queried[f.id] && !contains(candidates, f.id) {
+						candidates = append(candidates, f)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		// nodes that did not answer make room for the next closest ones
+		kept := candidates[:0]
+		for _, n := range candidates {
+			if !containsID(failed, n.id) {
+				kept = append(kept, n)
+			}
+		}
+		candidates = kept
+	}
+
+	sort.Slice(res.responded, func(i, j int) bool { return closer(target, res.responded[i].id, res.responded[j].id) })
+	if len(res.responded) > bucketSize {
+		res.responded = res.responded[:bucketSize]
+	}
+	return res
+}
+
+func contains(nodes []node, id [20]byte) bool {
+	for _, n := range nodes {
+		if n.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func containsID(ids [][20]byte, id [20]byte) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
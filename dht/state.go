@@ -0,0 +1,57 @@
+package dht
+
+import (
+	"bittorrent_client/bencodeutil"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jackpal/bencode-go"
+)
+
+type bencodeState struct {
+	ID    string `bencode:"id"`
+	Nodes string `bencode:"nodes"`
+}
+
+type state struct {
+	id    [20]byte
+	nodes []node
+}
+
+// saveState writes our ID and the routing table to path, so the next run can
+// rejoin without going through the bootstrap nodes.
+func saveState(path string, id [20]byte, nodes []node) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	s := bencodeState{ID: string(id[:]), Nodes: encodeNodes(nodes)}
+	return bencodeutil.WriteFile(path, s)
+}
+
+func loadState(path string) (state, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return state{}, nil
+	}
+	if err != nil {
+		return state{}, err
+	}
+	defer f.Close()
+	s := bencodeState{}
+	err = bencode.Unmarshal(f, &s)
+	if err != nil {
+		return state{}, err
+	}
+	if len(s.ID) != 20 {
+		return state{}, fmt.Errorf("DHT state has a malformed node ID")
+	}
+	var loaded state
+	copy(loaded.id[:], s.ID)
+	loaded.nodes, err = decodeNodes(s.Nodes)
+	if err != nil {
+		return state{}, err
+	}
+	return loaded, nil
+}
@@ -0,0 +1,61 @@
+package dht
+
+import (
+	"bittorrent_client/peers"
+	"sync"
+	"time"
+)
+
+const (
+	peerTTL          = 30 * time.Minute
+	maxPeersPerHash  = 200
+	maxPeersReturned = 50
+)
+
+// peerStore keeps the peers announced to us, per info-hash.
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[[20]byte]map[string]storedPeer
+}
+
+type storedPeer struct {
+	peer  peers.Peer
+	added time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: map[[20]byte]map[string]storedPeer{}}
+}
+
+func (s *peerStore) add(infoHash [20]byte, peer peers.Peer, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	swarm, ok := s.peers[infoHash]
+	if !ok {
+		swarm = map[string]storedPeer{}
+		s.peers[infoHash] = swarm
+	}
+	if _, ok := swarm[peer.String()]; !ok && len(swarm) >= maxPeersPerHash {
+		return
+	}
+	swarm[peer.String()] = storedPeer{peer: peer, added: now}
+}
+
+func (s *peerStore) get(infoHash [20]byte, now time.Time) []peers.Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ps []peers.Peer
+	for key, stored := range s.peers[infoHash] {
+		if now.Sub(stored.added) > peerTTL {
+			delete(s.peers[infoHash], key)
+			continue
+		}
+		if len(ps) < maxPeersReturned {
+			ps = append(ps, stored.peer)
+		}
+	}
+	if len(s.peers[infoHash]) == 0 {
+		delete(s.peers, infoHash)
+	}
+	return ps
+}
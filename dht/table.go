@@ -0,0 +1,141 @@
+package dht
+
+import (
+	"bytes"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	bucketSize  = 8 // K in Kademlia
+	maxFailures = 2 // unanswered queries before a node may be replaced
+)
+
+type node struct {
+	id       [20]byte
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+// table is the Kademlia routing table. Bucket i holds the nodes whose IDs
+// share exactly i leading bits with ours.
+type table struct {
+	mu      sync.Mutex
+	self    [20]byte
+	buckets [160][]*node
+}
+
+func newTable(self [20]byte) *table {
+	return &table{self: self}
+}
+
+func commonPrefixLen(a, b [20]byte) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(a) * 8
+}
+
+// closer reports whether a is closer to target than b by the XOR metric.
+func closer(target, a, b [20]byte) bool {
+	var da, db [20]byte
+	for i := range target {
+		da[i] = a[i] ^ target[i]
+		db[i] = b[i] ^ target[i]
+	}
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// insert records that n is alive. A full bucket only makes room by evicting a
+// node that stopped answering, so long-lived nodes are preferred.
+func (t *table) insert(n node) {
+	index := commonPrefixLen(t.self, n.id)
+	if index == len(t.buckets) {
+		return // ourselves
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bucket := t.buckets[index]
+	for i, existing := range bucket {
+		if existing.id == n.id {
+			existing.addr = n.addr
+			existing.lastSeen = n.lastSeen
+			existing.failures = 0
+			// keep the most recently seen node at the tail
+			t.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), existing)
+			return
+		}
+	}
+	if len(bucket) < bucketSize {
+		t.buckets[index] = append(bucket, &n)
+		return
+	}
+	for i, existing := range bucket {
+		if existing.failures >= maxFailures {
+			t.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), &n)
+			return
+		}
+	}
+}
+
+// failed counts an unanswered query against the node with id.
+func (t *table) failed(id [20]byte) {
+	index := commonPrefixLen(t.self, id)
+	if index == len(t.buckets) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, existing := range t.buckets[index] {
+		if existing.id == id {
+			existing.failures++
+		}
+	}
+}
+
+// closest returns up to n good nodes ordered by distance to target.
+func (t *table) closest(target [20]byte, n int) []node {
+	t.mu.Lock()
+	var all []node
+	for _, bucket := range t.buckets {
+		for _, existing := range bucket {
+			if existing.failures < maxFailures {
+				all = append(all, *existing)
+			}
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool { return closer(target, all[i].id, all[j].id) })
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+func (t *table) nodes() []node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var all []node
+	for _, bucket := range t.buckets {
+		for _, existing := range bucket {
+			all = append(all, *existing)
+		}
+	}
+	return all
+}
+
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, bucket := range t.buckets {
+		n += len(bucket)
+	}
+	return n
+}
@@ -0,0 +1,77 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommonPrefixLen(t *testing.T) {
+	tests := map[string]struct {
+		a, b   [20]byte
+		output int
+	}{
+		"equal":       {a: [20]byte{1}, b: [20]byte{1}, output: 160},
+		"first bit":   {a: [20]byte{0x80}, b: [20]byte{0x00}, output: 0},
+		"fourth bit":  {a: [20]byte{0x10}, b: [20]byte{0x00}, output: 3},
+		"second byte": {a: [20]byte{0xff, 0x01}, b: [20]byte{0xff, 0x00}, output: 15},
+	}
+	for name, test := range tests {
+		assert.Equal(t, test.output, commonPrefixLen(test.a, test.b), name)
+	}
+}
+
+func testNode(id byte, port int) node {
+	return node{id: [20]byte{id}, addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: port}, lastSeen: time.Now()}
+}
+
+func TestTableClosest(t *testing.T) {
+	tb := newTable([20]byte{})
+	for _, id := range []byte{0x80, 0x40, 0x41, 0x20, 0x01} {
+		tb.insert(testNode(id, int(id)))
+	}
+	tb.insert(node{id: [20]byte{}}) // ourselves
+	assert.Equal(t, 5, tb.len())
+
+	closest := tb.closest([20]byte{0x40}, 3)
+	ids := []byte{}
+	for _, n := range closest {
+		ids = append(ids, n.id[0])
+	}
+	assert.Equal(t, []byte{0x40, 0x41, 0x01}, ids)
+}
+
+func TestTableFullBucket(t *testing.T) {
+	tb := newTable([20]byte{})
+	// all of these share no prefix bits with us and land in bucket 0
+	for i := range bucketSize + 1 {
+		tb.insert(testNode(0x80+byte(i), i+1))
+	}
+	assert.Equal(t, bucketSize, tb.len())
+	assert.Len(t, tb.closest([20]byte{0x80 + bucketSize}, 20), bucketSize)
+	assert.NotEqual(t, [20]byte{0x80 + bucketSize}, tb.closest([20]byte{0x80 + bucketSize}, 1)[0].id)
+
+	// a node that stopped answering gives up its place
+	for range maxFailures {
+		tb.failed([20]byte{0x83})
+	}
+	tb.insert(testNode(0x80+bucketSize, 100))
+	assert.Equal(t, bucketSize, tb.len())
+	assert.Equal(t, [20]byte{0x80 + bucketSize}, tb.closest([20]byte{0x80 + bucketSize}, 1)[0].id)
+}
+
+func TestTableRefreshesKnownNode(t *testing.T) {
+	tb := newTable([20]byte{})
+	tb.insert(testNode(0x80, 1))
+	tb.failed([20]byte{0x80})
+	tb.failed([20]byte{0x80})
+	assert.Empty(t, tb.closest([20]byte{0x80}, 1))
+
+	tb.insert(testNode(0x80, 2))
+	closest := tb.closest([20]byte{0x80}, 1)
+	assert.Len(t, closest, 1)
+	assert.Equal(t, 2, closest[0].addr.Port)
+	assert.Equal(t, 1, tb.len())
+}
@@ -0,0 +1,57 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+// tokenRotation is how often the token secret changes. Tokens made with the
+// previous secret stay valid, so a token lives between 5 and 10 minutes.
+const tokenRotation = 5 * time.Minute
+
+// tokens hands out and checks the write tokens get_peers returns and
+// announce_peer must present, tying announces to the querying IP.
+type tokens struct {
+	mu       sync.Mutex
+	secret   [16]byte
+	previous [16]byte
+	rotated  time.Time
+}
+
+func newTokens() *tokens {
+	tm := &tokens{rotated: time.Now()}
+	rand.Read(tm.secret[:])
+	tm.previous = tm.secret
+	return tm
+}
+
+func (tm *tokens) rotateIfDue(now time.Time) {
+	if now.Sub(tm.rotated) < tokenRotation {
+		return
+	}
+	tm.previous = tm.secret
+	rand.Read(tm.secret[:])
+	tm.rotated = now
+}
+
+func tokenFor(secret [16]byte, ip net.IP) string {
+	hashed := sha1.Sum(append(secret[:], ip.To16()...))
+	return string(hashed[:8])
+}
+
+func (tm *tokens) create(ip net.IP) string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.rotateIfDue(time.Now())
+	return tokenFor(tm.secret, ip)
+}
+
+func (tm *tokens) valid(token string, ip net.IP) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.rotateIfDue(time.Now())
+	return token == tokenFor(tm.secret, ip) || token == tokenFor(tm.previous, ip)
+}
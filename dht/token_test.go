@@ -0,0 +1,25 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokens(t *testing.T) {
+	tm := newTokens()
+	ip := net.IP{10, 0, 0, 1}
+	token := tm.create(ip)
+
+	assert.True(t, tm.valid(token, ip))
+	assert.False(t, tm.valid(token, net.IP{10, 0, 0, 2}))
+	assert.False(t, tm.valid("forged", ip))
+
+	// still accepted after one rotation, but not after two
+	tm.rotated = time.Now().Add(-tokenRotation)
+	assert.True(t, tm.valid(token, ip))
+	tm.rotated = time.Now().Add(-tokenRotation)
+	assert.False(t, tm.valid(token, ip))
+}
@@ -5,18 +5,39 @@ import (
 	"io"
 )
 
+// Flag is a capability advertised in the reserved bytes, encoded as the index
+// of the byte in the high bits and the mask within it in the low bits.
+type Flag uint16
+
+const (
+	FlagDHT               Flag = 7<<8 | 0x01 // BEP 5
+	FlagFast              Flag = 7<<8 | 0x04 // BEP 6
+	FlagExtensionProtocol Flag = 5<<8 | 0x10 // BEP 10
+)
+
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
 func New(infoHash, peerID [20]byte) *Handshake {
-	return &Handshake{
+	h := &Handshake{
 		Pstr:     "BitTorrent protocol",
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	h.SetFlag(FlagExtensionProtocol)
+	return h
+}
+
+func (h *Handshake) SetFlag(f Flag) {
+	h.Reserved[f>>8] |= byte(f)
+}
+
+func (h Handshake) HasFlag(f Flag) bool {
+	return h.Reserved[f>>8]&byte(f) != 0
 }
 
 func (h Handshake) Serialize() []byte {
@@ -24,7 +45,7 @@ func (h Handshake) Serialize() []byte {
 	handshake[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(handshake[curr:], h.Pstr)
-	curr += copy(handshake[curr:], make([]byte, 8)) // 8 reserved bytes
+	curr += copy(handshake[curr:], h.Reserved[:])
 	curr += copy(handshake[curr:], h.InfoHash[:])
 	curr += copy(handshake[curr:], h.PeerID[:])
 	return handshake
@@ -47,15 +68,18 @@ func Read(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 	var infoHash, peerID [20]byte
+	var reserved [8]byte
 	const reservedBytes = 8
 	const pstrOffset = 20
 	pstr := string(handshakeBuf[:pstrlen])
 
+	copy(reserved[:], handshakeBuf[pstrlen:pstrlen+reservedBytes])
 	copy(infoHash[:], handshakeBuf[pstrlen+reservedBytes:pstrlen+reservedBytes+pstrOffset])
 	copy(peerID[:], handshakeBuf[pstrlen+reservedBytes+pstrOffset:])
 
 	return &Handshake{
 		Pstr:     pstr,
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}, nil
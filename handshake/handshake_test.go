@@ -13,12 +13,46 @@ func TestNew(t *testing.T) {
 	h := New(infoHash, peerID)
 	expected := &Handshake{
 		Pstr:     "BitTorrent protocol",
+		Reserved: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0},
 		InfoHash: [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116},
 		PeerID:   [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
 	}
 	assert.Equal(t, expected, h)
 }
 
+func TestFlags(t *testing.T) {
+	tests := map[string]struct {
+		flag     Flag
+		reserved [8]byte
+	}{
+		"extension protocol": {
+			flag:     FlagExtensionProtocol,
+			reserved: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0},
+		},
+		"dht": {
+			flag:     FlagDHT,
+			reserved: [8]byte{0, 0, 0, 0, 0, 0, 0, 0x01},
+		},
+		"fast": {
+			flag:     FlagFast,
+			reserved: [8]byte{0, 0, 0, 0, 0, 0, 0, 0x04},
+		},
+	}
+
+	for name, test := range tests {
+		h := Handshake{}
+		assert.False(t, h.HasFlag(test.flag), name)
+		h.SetFlag(test.flag)
+		assert.Equal(t, test.reserved, h.Reserved, name)
+		assert.True(t, h.HasFlag(test.flag), name)
+		for other := range tests {
+			if other != name {
+				assert.False(t, h.HasFlag(tests[other].flag), name)
+			}
+		}
+	}
+}
+
 func TestSerialize(t *testing.T) {
 	tests := map[string]struct {
 		input  *Handshake
@@ -32,6 +66,15 @@ func TestSerialize(t *testing.T) {
 			},
 			output: []byte{19, 66, 105, 116, 84, 111, 114, 114, 101, 110, 116, 32, 112, 114, 111, 116, 111, 99, 111, 108, 0, 0, 0, 0, 0, 0, 0, 0, 134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
 		},
+		"serialize reserved bytes": {
+			input: &Handshake{
+				Pstr:     "BitTorrent protocol",
+				Reserved: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x05},
+				InfoHash: [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116},
+				PeerID:   [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+			},
+			output: []byte{19, 66, 105, 116, 84, 111, 114, 114, 101, 110, 116, 32, 112, 114, 111, 116, 111, 99, 111, 108, 0, 0, 0, 0, 0, 0x10, 0, 0x05, 134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+		},
 	}
 
 	for _, test := range tests {
@@ -55,6 +98,16 @@ func TestRead(t *testing.T) {
 			},
 			fails: false,
 		},
+		"keeps reserved bytes": {
+			input: []byte{19, 66, 105, 116, 84, 111, 114, 114, 101, 110, 116, 32, 112, 114, 111, 116, 111, 99, 111, 108, 0, 0, 0, 0, 0, 0x10, 0, 0x05, 134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+			output: &Handshake{
+				Pstr:     "BitTorrent protocol",
+				Reserved: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x05},
+				InfoHash: [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116},
+				PeerID:   [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+			},
+			fails: false,
+		},
 		"empty": {
 			input:  []byte{},
 			output: nil,
@@ -0,0 +1,236 @@
+package lsd
+
+import (
+	"bittorrent_client/peers"
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Multicast groups from BEP 14
+const (
+	Group4 = "239.192.152.143:6771"
+	Group6 = "[ff15::efc0:988f]:6771"
+)
+
+const (
+	// AnnounceInterval is how often active torrents are announced
+	AnnounceInterval = 5 * time.Minute
+	// minAnnounceInterval rate limits announces of a single info-hash
+	minAnnounceInterval = time.Minute
+	maxPacketSize       = 1400
+)
+
+// LSD announces torrents on the local network and reports the LAN peers that
+// announce the same ones.
+type LSD struct {
+	conn   *net.UDPConn
+	group  *net.UDPAddr
+	port   uint16
+	cookie string
+
+	mu           sync.Mutex
+	subscribers  map[[20]byte]chan []peers.Peer
+	lastAnnounce map[[20]byte]time.Time
+
+	closed chan struct{}
+	done   chan struct{}
+}
+
+// New joins group, announcing that we accept peer connections on port. A
+// unicast group address is listened on directly, which is only useful for
+// testing.
+func New(group string, port uint16) (*LSD, error) {
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, err
+	}
+	var conn *net.UDPConn
+	if addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", nil, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cookie [8]byte
+	rand.Read(cookie[:])
+	l := &LSD{
+		conn:         conn,
+		group:        addr,
+		port:         port,
+		cookie:       hex.EncodeToString(cookie[:]),
+		subscribers:  map[[20]byte]chan []peers.Peer{},
+		lastAnnounce: map[[20]byte]time.Time{},
+		closed:       make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go l.serve()
+	return l, nil
+}
+
+func (l *LSD) Addr() *net.UDPAddr {
+	return l.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (l *LSD) Close() error {
+	select {
+	case <-l.closed:
+		return nil
+	default:
+	}
+	close(l.closed)
+	err := l.conn.Close()
+	<-l.done
+	return err
+}
+
+// Subscribe returns the channel LAN peers announcing infoHash are delivered
+// on. Peers are dropped when the channel is full.
+func (l *LSD) Subscribe(infoHash [20]byte) <-chan []peers.Peer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ch, ok := l.subscribers[infoHash]
+	if !ok {
+		ch = make(chan []peers.Peer, 16)
+		l.subscribers[infoHash] = ch
+	}
+	return ch
+}
+
+func (l *LSD) Unsubscribe(infoHash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.subscribers, infoHash)
+}
+
+// Announce multicasts a BT-SEARCH for the info-hashes that were not announced
+// within the last minute.
+func (l *LSD) Announce(infoHashes ...[20]byte) error {
+	now := time.Now()
+	var due [][20]byte
+	l.mu.Lock()
+	for _, infoHash := range infoHashes {
+		if now.Sub(l.lastAnnounce[infoHash]) < minAnnounceInterval {
+			continue
+		}
+		l.lastAnnounce[infoHash] = now
+		due = append(due, infoHash)
+	}
+	l.mu.Unlock()
+
+	for len(due) > 0 {
+		packet, n := formatSearch(l.group.String(), l.port, due, l.cookie)
+		_, err := l.conn.WriteToUDP(packet, l.group)
+		if err != nil {
+			return err
+		}
+		due = due[n:]
+	}
+	return nil
+}
+
+func (l *LSD) serve() {
+	defer close(l.done)
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			continue
+		}
+		l.handle(buf[:n], from)
+	}
+}
+
+func (l *LSD) handle(packet []byte, from *net.UDPAddr) {
+	s, err := parseSearch(packet)
+	if err != nil || s.cookie == l.cookie {
+		return // malformed or our own announce looping back
+	}
+	peer := peers.Peer{IP: from.IP, Port: s.port}
+	if ip4 := peer.IP.To4(); ip4 != nil {
+		peer.IP = ip4
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, infoHash := range s.infoHashes {
+		ch, ok := l.subscribers[infoHash]
+		if !ok {
+			continue
+		}
+		select {
+		case ch <- []peers.Peer{peer}:
+		default:
+		}
+	}
+}
+
+type search struct {
+	port       uint16
+	infoHashes [][20]byte
+	cookie     string
+}
+
+// formatSearch builds a BT-SEARCH message with as many of infoHashes as fit
+// in one packet and returns how many it took.
+func formatSearch(host string, port uint16, infoHashes [][20]byte, cookie string) ([]byte, int) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", host, port)
+	n := 0
+	for _, infoHash := range infoHashes {
+		line := fmt.Sprintf("Infohash: %x\r\n", infoHash)
+		if n > 0 && buf.Len()+len(line)+len(cookie)+16 > maxPacketSize {
+			break
+		}
+		buf.WriteString(line)
+		n++
+	}
+	if cookie != "" {
+		fmt.Fprintf(&buf, "cookie: %s\r\n", cookie)
+	}
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes(), n
+}
+
+func parseSearch(packet []byte) (search, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(packet)))
+	if err != nil {
+		return search{}, err
+	}
+	if req.Method != "BT-SEARCH" {
+		return search{}, fmt.Errorf("unexpected method %q", req.Method)
+	}
+	port, err := strconv.ParseUint(req.Header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return search{}, fmt.Errorf("invalid port %q", req.Header.Get("Port"))
+	}
+	s := search{port: uint16(port), cookie: req.Header.Get("Cookie")}
+	for _, encoded := range req.Header.Values("Infohash") {
+		decoded, err := hex.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(decoded) != 20 {
+			continue
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], decoded)
+		s.infoHashes = append(s.infoHashes, infoHash)
+	}
+	if len(s.infoHashes) == 0 {
+		return search{}, fmt.Errorf("BT-SEARCH without info-hash")
+	}
+	return s, nil
+}
@@ -0,0 +1,143 @@
+package lsd
+
+import (
+	"bittorrent_client/peers"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatSearch(t *testing.T) {
+	infoHash := [20]byte{0xde, 0xe8, 0x6a, 0x7f, 0xa6, 0xf2, 0x86, 0xa9, 0xd7, 0x4c, 0x36, 0x20, 0x14, 0x61, 0x6a, 0x0f, 0xf5, 0xe4, 0x84, 0x3d}
+	packet, n := formatSearch(Group4, 6881, [][20]byte{infoHash}, "abc")
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "BT-SEARCH * HTTP/1.1\r\n"+
+		"Host: 239.192.152.143:6771\r\n"+
+		"Port: 6881\r\n"+
+		"Infohash: dee86a7fa6f286a9d74c362014616a0ff5e4843d\r\n"+
+		"cookie: abc\r\n"+
+		"\r\n\r\n", string(packet))
+}
+
+func TestFormatSearchSplitsLargeAnnounces(t *testing.T) {
+	infoHashes := make([][20]byte, 100)
+	for i := range infoHashes {
+		infoHashes[i][0] = byte(i)
+	}
+	packet, n := formatSearch(Group4, 6881, infoHashes, "abc")
+	assert.Less(t, n, len(infoHashes))
+	assert.LessOrEqual(t, len(packet), maxPacketSize)
+
+	s, err := parseSearch(packet)
+	assert.Nil(t, err)
+	assert.Equal(t, infoHashes[:n], s.infoHashes)
+}
+
+func TestParseSearch(t *testing.T) {
+	infoHash := [20]byte{0xde, 0xe8, 0x6a, 0x7f, 0xa6, 0xf2, 0x86, 0xa9, 0xd7, 0x4c, 0x36, 0x20, 0x14, 0x61, 0x6a, 0x0f, 0xf5, 0xe4, 0x84, 0x3d}
+	tests := map[string]struct {
+		input  string
+		output search
+		fails  bool
+	}{
+		"two info-hashes": {
+			input: "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 51413\r\n" +
+				"Infohash: dee86a7fa6f286a9d74c362014616a0ff5e4843d\r\n" +
+				"Infohash: DEE86A7FA6F286A9D74C362014616A0FF5E4843D\r\n" +
+				"cookie: xyz\r\n\r\n\r\n",
+			output: search{port: 51413, infoHashes: [][20]byte{infoHash, infoHash}, cookie: "xyz"},
+		},
+		"skips malformed info-hashes": {
+			input: "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 51413\r\n" +
+				"Infohash: nothex\r\n" +
+				"Infohash: dee86a7fa6f286a9d74c362014616a0ff5e4843d\r\n\r\n\r\n",
+			output: search{port: 51413, infoHashes: [][20]byte{infoHash}},
+		},
+		"missing port": {
+			input:  "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nInfohash: dee86a7fa6f286a9d74c362014616a0ff5e4843d\r\n\r\n\r\n",
+			output: search{},
+			fails:  true,
+		},
+		"no info-hash": {
+			input:  "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 51413\r\n\r\n\r\n",
+			output: search{},
+			fails:  true,
+		},
+		"wrong method": {
+			input:  "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			output: search{},
+			fails:  true,
+		},
+	}
+
+	for name, test := range tests {
+		s, err := parseSearch([]byte(test.input))
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, s, name)
+	}
+}
+
+// startPair starts two instances on localhost that announce to each other.
+func startPair(t *testing.T) (a, b *LSD) {
+	a, err := New("127.0.0.1:0", 6881)
+	require.Nil(t, err)
+	t.Cleanup(func() { a.Close() })
+	b, err = New("127.0.0.1:0", 51413)
+	require.Nil(t, err)
+	t.Cleanup(func() { b.Close() })
+	a.group, b.group = b.Addr(), a.Addr()
+	return a, b
+}
+
+func TestAnnounceReachesSubscriber(t *testing.T) {
+	a, b := startPair(t)
+	infoHash := [20]byte{1}
+	found := a.Subscribe(infoHash)
+	other := a.Subscribe([20]byte{2})
+
+	require.Nil(t, b.Announce(infoHash))
+	select {
+	case ps := <-found:
+		assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 51413}}, ps)
+	case <-time.After(2 * time.Second):
+		t.Fatal("announce did not arrive")
+	}
+	assert.Empty(t, other)
+}
+
+func TestAnnounceIsRateLimited(t *testing.T) {
+	a, b := startPair(t)
+	infoHash := [20]byte{1}
+	found := a.Subscribe(infoHash)
+
+	require.Nil(t, b.Announce(infoHash))
+	require.Nil(t, b.Announce(infoHash))
+	<-found
+	select {
+	case <-found:
+		t.Fatal("second announce within a minute was sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestIgnoresOwnAnnounces(t *testing.T) {
+	a, err := New("127.0.0.1:0", 6881)
+	require.Nil(t, err)
+	defer a.Close()
+	a.group = a.Addr()
+	found := a.Subscribe([20]byte{1})
+
+	require.Nil(t, a.Announce([20]byte{1}))
+	select {
+	case <-found:
+		t.Fatal("own announce was reported")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,118 @@
+package magnet
+
+import (
+	"bittorrent_client/peers"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const btihPrefix = "urn:btih:"
+
+// Magnet holds the fields of a magnet URI that matter for BitTorrent.
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string
+	Trackers []string
+	Peers    []peers.Peer
+	WebSeeds []string
+}
+
+func Parse(uri string) (Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return Magnet{}, err
+	}
+	if u.Scheme != "magnet" {
+		return Magnet{}, fmt.Errorf("not a magnet link: %q", uri)
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return Magnet{}, err
+	}
+
+	var m Magnet
+	found := false
+	for _, xt := range values(query, "xt") {
+		if !strings.HasPrefix(xt, btihPrefix) {
+			continue // e.g. a BitTorrent v2 btmh hash
+		}
+		m.InfoHash, err = parseInfoHash(strings.TrimPrefix(xt, btihPrefix))
+		if err != nil {
+			return Magnet{}, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return Magnet{}, fmt.Errorf("magnet link has no btih info hash")
+	}
+
+	m.Name = query.Get("dn")
+	m.Trackers = values(query, "tr")
+	m.WebSeeds = values(query, "ws")
+	for _, pe := range values(query, "x.pe") {
+		peer, err := parsePeer(pe)
+		if err != nil {
+			continue // hostnames and malformed entries are skipped
+		}
+		m.Peers = append(m.Peers, peer)
+	}
+	return m, nil
+}
+
+// values returns the parameters named key, including the numbered variants
+// such as tr.1 and tr.2 some clients emit.
+func values(query url.Values, key string) []string {
+	vals := append([]string(nil), query[key]...)
+	for i := 1; ; i++ {
+		numbered, ok := query[key+"."+strconv.Itoa(i)]
+		if !ok {
+			return vals
+		}
+		vals = append(vals, numbered...)
+	}
+}
+
+// parseInfoHash accepts the 40 character hex and 32 character base32 forms.
+func parseInfoHash(encoded string) ([20]byte, error) {
+	var infoHash [20]byte
+	var decoded []byte
+	var err error
+	switch len(encoded) {
+	case 40:
+		decoded, err = hex.DecodeString(encoded)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		err = fmt.Errorf("info hash %q has invalid length %d", encoded, len(encoded))
+	}
+	if err != nil {
+		return infoHash, err
+	}
+	copy(infoHash[:], decoded)
+	return infoHash, nil
+}
+
+func parsePeer(hostPort string) (peers.Peer, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return peers.Peer{}, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return peers.Peer{}, fmt.Errorf("peer address %q is not an IP", host)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return peers.Peer{}, err
+	}
+	return peers.Peer{IP: ip, Port: uint16(portNum)}, nil
+}
@@ -0,0 +1,77 @@
+package magnet
+
+import (
+	"bittorrent_client/peers"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	infoHash := [20]byte{0xde, 0xe8, 0x6a, 0x7f, 0xa6, 0xf2, 0x86, 0xa9, 0xd7, 0x4c, 0x36, 0x20, 0x14, 0x61, 0x6a, 0x0f, 0xf5, 0xe4, 0x84, 0x3d}
+	tests := map[string]struct {
+		input  string
+		output Magnet
+		fails  bool
+	}{
+		"hex info hash with all fields": {
+			input: "magnet:?xt=urn:btih:dee86a7fa6f286a9d74c362014616a0ff5e4843d" +
+				"&dn=archlinux-2019.12.01-x86_64.iso" +
+				"&tr=http%3A%2F%2Ftracker.archlinux.org%3A6969%2Fannounce" +
+				"&tr=udp%3A%2F%2Ftracker.example.org%3A1337" +
+				"&x.pe=127.0.0.1:6881&x.pe=[2001:db8::1]:6882&x.pe=peer.example.org:6883" +
+				"&ws=http%3A%2F%2Fmirror.example.org%2Farch.iso",
+			output: Magnet{
+				InfoHash: infoHash,
+				Name:     "archlinux-2019.12.01-x86_64.iso",
+				Trackers: []string{"http://tracker.archlinux.org:6969/announce", "udp://tracker.example.org:1337"},
+				Peers: []peers.Peer{
+					{IP: net.IP{127, 0, 0, 1}, Port: 6881},
+					{IP: net.ParseIP("2001:db8::1"), Port: 6882},
+				},
+				WebSeeds: []string{"http://mirror.example.org/arch.iso"},
+			},
+		},
+		"base32 info hash": {
+			input:  "magnet:?xt=urn:btih:33UGU75G6KDKTV2MGYQBIYLKB726JBB5",
+			output: Magnet{InfoHash: infoHash},
+		},
+		"numbered trackers": {
+			input: "magnet:?xt=urn:btih:dee86a7fa6f286a9d74c362014616a0ff5e4843d&tr.1=http%3A%2F%2Fa%2Fannounce&tr.2=http%3A%2F%2Fb%2Fannounce",
+			output: Magnet{
+				InfoHash: infoHash,
+				Trackers: []string{"http://a/announce", "http://b/announce"},
+			},
+		},
+		"skips v2 hashes": {
+			input:  "magnet:?xt=urn:btmh:1220caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e&xt=urn:btih:dee86a7fa6f286a9d74c362014616a0ff5e4843d",
+			output: Magnet{InfoHash: infoHash},
+		},
+		"not a magnet link": {
+			input:  "http://example.com/file.torrent",
+			output: Magnet{},
+			fails:  true,
+		},
+		"missing info hash": {
+			input:  "magnet:?dn=file",
+			output: Magnet{},
+			fails:  true,
+		},
+		"malformed info hash": {
+			input:  "magnet:?xt=urn:btih:zz",
+			output: Magnet{},
+			fails:  true,
+		},
+	}
+
+	for _, test := range tests {
+		m, err := Parse(test.input)
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.output, m)
+	}
+}
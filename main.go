@@ -1,22 +1,112 @@
 package main
 
 import (
+	"bittorrent_client/ratelimit"
 	"bittorrent_client/torrent"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
+const usage = `usage:
+  bittorrent_client [download] [-ratio r] [-seed-time d] [-down-limit rate] [-up-limit rate]
+                    [-schedule from-to=down/up]... [-max-peers n] [-max-conns n]
+                    <file.torrent|magnet link> <output path>
+  bittorrent_client scrape <file.torrent>...`
+
 func main() {
-	inPath := os.Args[1]
-	outPath := os.Args[2]
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "scrape" {
+		scrape(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "download" {
+		args = args[1:]
+	}
+	flags := flag.NewFlagSet("download", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, usage) }
+	flags.Float64Var(&torrent.SeedRatio, "ratio", torrent.SeedRatio, "stop seeding after uploading this many times the download size, 0 for no limit")
+	flags.DurationVar(&torrent.SeedTime, "seed-time", torrent.SeedTime, "stop seeding after this long, 0 for no limit")
+	var schedule ratelimit.Schedule
+	flags.Func("down-limit", "limit downloads to this many bytes per second, such as 512k", func(s string) (err error) {
+		schedule.Download, err = ratelimit.ParseRate(s)
+		return err
+	})
+	flags.Func("up-limit", "limit uploads to this many bytes per second, such as 512k", func(s string) (err error) {
+		schedule.Upload, err = ratelimit.ParseRate(s)
+		return err
+	})
+	flags.Func("schedule", "use other limits at times of day, such as 09:00-17:00=1M/256k", func(s string) error {
+		r, err := ratelimit.ParseRule(s)
+		schedule.Rules = append(schedule.Rules, r)
+		return err
+	})
+	flags.IntVar(&torrent.MaxConnections, "max-peers", torrent.MaxConnections, "connect to at most this many peers per download")
+	maxConns := flags.Int("max-conns", 200, "keep at most this many peer connections open in total, 0 for no limit")
+	flags.Parse(args)
+	args = flags.Args()
+	torrent.GlobalConnections.SetMax(*maxConns)
+	torrent.DownloadLimit.SetRate(schedule.Download)
+	torrent.UploadLimit.SetRate(schedule.Upload)
+	if len(schedule.Rules) > 0 {
+		torrent.Schedule = &schedule
+	}
+	if len(args) != 2 {
+		log.Fatal(usage)
+	}
+	download(args[0], args[1])
+}
 
-	tf, err := torrent.OpenTorrent(inPath)
+func download(inPath, outPath string) {
+	open := torrent.OpenTorrent
+	if strings.HasPrefix(inPath, "magnet:") {
+		open = torrent.OpenMagnet
+	}
+	tf, err := open(inPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// stop cleanly on Ctrl-C or SIGTERM so trackers get the stopped event; a
+	// second signal kills us right away
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		log.Printf("Received %s, stopping\n", sig)
+		close(torrent.Stop)
+	}()
+
 	err = tf.DownloadTorrent(outPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+func scrape(paths []string) {
+	if len(paths) == 0 {
+		log.Fatal(usage)
+	}
+	tfs := make([]torrent.TorrentFile, len(paths))
+	for i, path := range paths {
+		tf, err := torrent.OpenTorrent(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tfs[i] = tf
+	}
+	results, errs := torrent.ScrapeTorrents(tfs)
+	for i, tf := range tfs {
+		if errs[i] != nil {
+			log.Printf("%s: %v\n", tf.Name, errs[i])
+			continue
+		}
+		res := results[i]
+		fmt.Printf("%s: %d seeders, %d leechers, %d completed\n", tf.Name, res.Seeders, res.Leechers, res.Completed)
+	}
+}
@@ -2,6 +2,7 @@ package message
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 )
@@ -16,8 +17,16 @@ const (
 	MsgRequest       uint8 = 6
 	MsgPiece         uint8 = 7
 	MsgCancel        uint8 = 8
+	MsgExtended      uint8 = 20
 )
 
+// MaxLength caps the length of messages Read accepts, leaving room for
+// bitfields of large torrents and blocks bigger than the usual 16KiB.
+const MaxLength = 1 << 20
+
+// ErrTooLong is returned by Read for a message longer than MaxLength.
+var ErrTooLong = errors.New("message too long")
+
 type Message struct {
 	ID      uint8
 	Payload []byte
@@ -31,12 +40,45 @@ func FormatRequest(index, begin, length int) *Message {
 	return &Message{ID: MsgRequest, Payload: payload}
 }
 
+func FormatCancel(index, begin, length int) *Message {
+	msg := FormatRequest(index, begin, length)
+	msg.ID = MsgCancel
+	return msg
+}
+
+func FormatPiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
 func FormatHave(index int) *Message {
 	payload := make([]byte, 4)
 	binary.BigEndian.PutUint32(payload, uint32(index))
 	return &Message{ID: MsgHave, Payload: payload}
 }
 
+// FormatExtended wraps an extension protocol (BEP 10) payload. extendedID 0 is
+// the extended handshake, other IDs are the ones negotiated in it.
+func FormatExtended(extendedID uint8, payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = extendedID
+	copy(buf[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
+func ParseExtended(msg *Message) (uint8, []byte, error) {
+	if msg == nil || msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("not an extended message")
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("payload too short")
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
 func (m *Message) Serialize() []byte {
 	if m == nil {
 		return make([]byte, 4)
@@ -61,6 +103,21 @@ func ParseHave(msg *Message) (int, error) {
 	return index, nil
 }
 
+// ParseRequest parses a request message, or a cancel message since it carries
+// the same payload.
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if msg == nil || (msg.ID != MsgRequest && msg.ID != MsgCancel) {
+		return 0, 0, 0, fmt.Errorf("not a request or cancel message")
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("expected payload length 12, got length %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
 func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	if msg == nil || msg.ID != MsgPiece {
 		return 0, fmt.Errorf("not a piece message")
@@ -84,6 +141,19 @@ func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	return len(data), nil
 }
 
+// ParseBlock parses a piece message without knowing which block it answers.
+func ParseBlock(msg *Message) (index, begin int, block []byte, err error) {
+	if msg == nil || msg.ID != MsgPiece {
+		return 0, 0, nil, fmt.Errorf("not a piece message")
+	}
+	if len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("payload too short")
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
+}
+
 func Read(r io.Reader) (*Message, error) {
 	lengthBuf := make([]byte, 4)
 	_, err := io.ReadFull(r, lengthBuf)
@@ -94,6 +164,9 @@ func Read(r io.Reader) (*Message, error) {
 	if length == 0 {
 		return nil, err
 	}
+	if length > MaxLength {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTooLong, length)
+	}
 	messageBuf := make([]byte, length)
 	_, err = io.ReadFull(r, messageBuf)
 	if err != nil {
@@ -131,6 +204,8 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgExtended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
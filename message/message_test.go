@@ -21,6 +21,81 @@ func TestFormatRequest(t *testing.T) {
 	assert.Equal(t, expected, msg)
 }
 
+func TestFormatCancel(t *testing.T) {
+	msg := FormatCancel(4, 567, 4321)
+	expected := &Message{
+		ID: MsgCancel,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04, // Index
+			0x00, 0x00, 0x02, 0x37, // Begin
+			0x00, 0x00, 0x10, 0xe1, // Length
+		},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestFormatPiece(t *testing.T) {
+	msg := FormatPiece(4, 2, []byte{0xaa, 0xbb, 0xcc})
+	expected := &Message{
+		ID: MsgPiece,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04, // Index
+			0x00, 0x00, 0x00, 0x02, // Begin
+			0xaa, 0xbb, 0xcc, // Block
+		},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestParseRequest(t *testing.T) {
+	tests := map[string]struct {
+		input  *Message
+		index  int
+		begin  int
+		length int
+		fails  bool
+	}{
+		"parse valid request": {
+			input:  FormatRequest(4, 567, 4321),
+			index:  4,
+			begin:  567,
+			length: 4321,
+			fails:  false,
+		},
+		"parse valid cancel": {
+			input:  FormatCancel(4, 567, 4321),
+			index:  4,
+			begin:  567,
+			length: 4321,
+			fails:  false,
+		},
+		"wrong message type": {
+			input: &Message{ID: MsgPiece, Payload: make([]byte, 12)},
+			fails: true,
+		},
+		"payload too short": {
+			input: &Message{ID: MsgRequest, Payload: []byte{0x00, 0x00, 0x00, 0x04}},
+			fails: true,
+		},
+		"nil message": {
+			input: nil,
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		index, begin, length, err := ParseRequest(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.index, index, name)
+		assert.Equal(t, test.begin, begin, name)
+		assert.Equal(t, test.length, length, name)
+	}
+}
+
 func TestFormatHave(t *testing.T) {
 	msg := FormatHave(4)
 	expected := &Message{
@@ -30,6 +105,99 @@ func TestFormatHave(t *testing.T) {
 	assert.Equal(t, expected, msg)
 }
 
+func TestFormatExtended(t *testing.T) {
+	msg := FormatExtended(3, []byte("d1:ai1ee"))
+	expected := &Message{
+		ID:      MsgExtended,
+		Payload: []byte{3, 'd', '1', ':', 'a', 'i', '1', 'e', 'e'},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestParseExtended(t *testing.T) {
+	tests := map[string]struct {
+		input   *Message
+		id      uint8
+		payload []byte
+		fails   bool
+	}{
+		"parse valid message": {
+			input:   &Message{ID: MsgExtended, Payload: []byte{0, 'd', 'e'}},
+			id:      0,
+			payload: []byte{'d', 'e'},
+			fails:   false,
+		},
+		"wrong message type": {
+			input:   &Message{ID: MsgHave, Payload: []byte{0, 0, 0, 4}},
+			id:      0,
+			payload: nil,
+			fails:   true,
+		},
+		"payload too short": {
+			input:   &Message{ID: MsgExtended, Payload: []byte{}},
+			id:      0,
+			payload: nil,
+			fails:   true,
+		},
+	}
+
+	for _, test := range tests {
+		id, payload, err := ParseExtended(test.input)
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.id, id)
+		assert.Equal(t, test.payload, payload)
+	}
+}
+
+func TestParseBlock(t *testing.T) {
+	tests := map[string]struct {
+		input *Message
+		index int
+		begin int
+		block []byte
+		fails bool
+	}{
+		"parse valid block": {
+			input: &Message{
+				ID: MsgPiece,
+				Payload: []byte{
+					0x00, 0x00, 0x00, 0x04, // Index
+					0x00, 0x00, 0x00, 0x02, // Begin
+					0xaa, 0xbb, 0xcc, // Block
+				},
+			},
+			index: 4,
+			begin: 2,
+			block: []byte{0xaa, 0xbb, 0xcc},
+			fails: false,
+		},
+		"wrong message type": {
+			input: &Message{ID: MsgHave, Payload: []byte{0x00, 0x00, 0x00, 0x04}},
+			fails: true,
+		},
+		"payload too short": {
+			input: &Message{ID: MsgPiece, Payload: []byte{0x00, 0x00, 0x00, 0x04}},
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		index, begin, block, err := ParseBlock(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.index, index, name)
+		assert.Equal(t, test.begin, begin, name)
+		assert.Equal(t, test.block, block, name)
+	}
+}
+
 func TestParsePiece(t *testing.T) {
 	tests := map[string]struct {
 		inputIndex int
@@ -225,6 +393,11 @@ func TestRead(t *testing.T) {
 			output: nil,
 			fails:  true,
 		},
+		"length over the maximum": {
+			input:  []byte{0xff, 0xff, 0xff, 0xff, 4, 1, 2, 3, 4},
+			output: nil,
+			fails:  true,
+		},
 	}
 
 	for _, test := range tests {
@@ -239,6 +412,12 @@ func TestRead(t *testing.T) {
 	}
 }
 
+func TestReadTooLong(t *testing.T) {
+	input := []byte{0, 0x10, 0, 1, MsgPiece}
+	_, err := Read(bytes.NewReader(input))
+	assert.ErrorIs(t, err, ErrTooLong)
+}
+
 func TestString(t *testing.T) {
 	tests := []struct {
 		input  *Message
@@ -254,6 +433,7 @@ func TestString(t *testing.T) {
 		{&Message{MsgRequest, []byte{1, 2, 3}}, "Request [3]"},
 		{&Message{MsgPiece, []byte{1, 2, 3}}, "Piece [3]"},
 		{&Message{MsgCancel, []byte{1, 2, 3}}, "Cancel [3]"},
+		{&Message{MsgExtended, []byte{1, 2, 3}}, "Extended [3]"},
 		{&Message{99, []byte{1, 2, 3}}, "Unknown#99 [3]"},
 	}
 
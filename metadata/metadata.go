@@ -0,0 +1,186 @@
+package metadata
+
+import (
+	"bittorrent_client/bencodeutil"
+	"bittorrent_client/client"
+	"bittorrent_client/message"
+	"bittorrent_client/peers"
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// BEP 9 ut_metadata message types
+const (
+	msgRequest = 0
+	msgData    = 1
+	msgReject  = 2
+)
+
+const (
+	utMetadataID    = 1 // the ID we ask peers to use for ut_metadata
+	pieceSize       = 16384
+	maxMetadataSize = 16 << 20
+	maxConcurrent   = 8
+)
+
+// fetchTimeout bounds the whole exchange with a single peer.
+var fetchTimeout = 30 * time.Second
+
+// Fetch downloads the info dictionary of the torrent identified by infoHash
+// from the first of ps that can provide it, and returns it once its SHA-1
+// matches infoHash.
+func Fetch(ps []peers.Peer, peerID, infoHash [20]byte) ([]byte, error) {
+	if len(ps) == 0 {
+		return nil, fmt.Errorf("no peers to fetch metadata from")
+	}
+	type result struct {
+		info []byte
+		err  error
+	}
+	results := make(chan result, len(ps))
+	slots := make(chan struct{}, maxConcurrent)
+	done := make(chan struct{})
+	defer close(done)
+	for _, peer := range ps {
+		go func() {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				results <- result{err: fmt.Errorf("%s: not tried", peer)}
+				return
+			}
+			defer func() { <-slots }()
+			info, err := fetchFrom(peer, peerID, infoHash)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", peer, err)
+			}
+			results <- result{info: info, err: err}
+		}()
+	}
+
+	var errs []error
+	for range ps {
+		res := <-results
+		if res.err == nil {
+			return res.info, nil
+		}
+		errs = append(errs, res.err)
+	}
+	return nil, fmt.Errorf("no peer provided the metadata: %w", errors.Join(errs...))
+}
+
+func fetchFrom(peer peers.Peer, peerID, infoHash [20]byte) ([]byte, error) {
+	c, err := client.DialExtended(peer, peerID, infoHash, map[string]uint8{"ut_metadata": utMetadataID})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Conn.Close()
+	c.Conn.SetDeadline(time.Now().Add(fetchTimeout))
+
+	var info []byte
+	var received []bool
+	remaining := 0
+	for {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue // keep-alives, bitfields and the like
+		}
+		name, payload, err := c.ReadExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case info == nil && c.Extended != nil:
+			// the peer's extended handshake arrived
+			if !c.SupportsExtension("ut_metadata") {
+				return nil, fmt.Errorf("peer does not support ut_metadata")
+			}
+			size := c.Extended.MetadataSize
+			if size <= 0 || size > maxMetadataSize {
+				return nil, fmt.Errorf("invalid metadata size %d", size)
+			}
+			info = make([]byte, size)
+			remaining = (size + pieceSize - 1) / pieceSize
+			received = make([]bool, remaining)
+			for piece := range remaining {
+				err = sendExtended(c, map[string]interface{}{
+					"msg_type": msgRequest,
+					"piece":    piece,
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+		case name == "ut_metadata" && info != nil:
+			dict, data, err := decodeDict(payload)
+			if err != nil {
+				return nil, err
+			}
+			piece := bencodeutil.Int(dict["piece"])
+			switch bencodeutil.Int(dict["msg_type"]) {
+			case msgReject:
+				return nil, fmt.Errorf("peer rejected metadata piece %d", piece)
+			case msgData:
+			default:
+				continue
+			}
+			if piece < 0 || piece >= len(received) {
+				return nil, fmt.Errorf("received invalid metadata piece %d", piece)
+			}
+			begin := piece * pieceSize
+			if len(data) != min(pieceSize, len(info)-begin) {
+				return nil, fmt.Errorf("metadata piece %d has length %d", piece, len(data))
+			}
+			if !received[piece] {
+				copy(info[begin:], data)
+				received[piece] = true
+				remaining--
+			}
+			if remaining == 0 {
+				if sha1.Sum(info) != infoHash {
+					return nil, fmt.Errorf("metadata does not match infohash %x", infoHash)
+				}
+				return info, nil
+			}
+		}
+	}
+}
+
+func sendExtended(c *client.Client, dict map[string]interface{}) error {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, dict)
+	if err != nil {
+		return err
+	}
+	return c.SendExtended("ut_metadata", buf.Bytes())
+}
+
+// decodeDict decodes the bencoded dictionary at the start of payload and
+// returns it along with whatever follows it, which is how ut_metadata appends
+// the piece data.
+func decodeDict(payload []byte) (map[string]interface{}, []byte, error) {
+	r := bytes.NewReader(payload)
+	// bencode.Decode wraps readers that are not buffered, so hand it our own
+	// to be able to tell how much it consumed
+	br := bufio.NewReader(r)
+	decoded, err := bencode.Decode(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("extended message is not a dictionary")
+	}
+	consumed := len(payload) - r.Len() - br.Buffered()
+	return dict, payload[consumed:], nil
+}
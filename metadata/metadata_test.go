@@ -0,0 +1,165 @@
+package metadata
+
+import (
+	"bittorrent_client/bencodeutil"
+	"bittorrent_client/handshake"
+	"bittorrent_client/message"
+	"bittorrent_client/peers"
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakePeer struct {
+	info       []byte
+	extensions bool
+	reject     bool
+}
+
+// serve answers a single connection the way a seeder supporting ut_metadata
+// would.
+func (fp fakePeer) serve(t *testing.T, listener net.Listener) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	req, err := handshake.Read(conn)
+	require.Nil(t, err)
+	res := handshake.New(req.InfoHash, [20]byte{})
+	if !fp.extensions {
+		res.Reserved = [8]byte{}
+	}
+	conn.Write(res.Serialize())
+	conn.Write((&message.Message{ID: message.MsgBitfield, Payload: []byte{0xff}}).Serialize())
+
+	const fakeMetadataID = 3
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		extendedID, payload, err := message.ParseExtended(msg)
+		require.Nil(t, err)
+		dict, _, err := decodeDict(payload)
+		require.Nil(t, err)
+
+		if extendedID == 0 {
+			m := dict["m"].(map[string]interface{})
+			assert.Equal(t, int64(utMetadataID), m["ut_metadata"])
+			writeExtended(conn, 0, map[string]interface{}{
+				"m":             map[string]interface{}{"ut_metadata": fakeMetadataID},
+				"metadata_size": len(fp.info),
+			})
+			continue
+		}
+		require.Equal(t, uint8(fakeMetadataID), extendedID)
+		piece := bencodeutil.Int(dict["piece"])
+		if fp.reject {
+			writeExtended(conn, utMetadataID, map[string]interface{}{"msg_type": msgReject, "piece": piece})
+			continue
+		}
+		var buf bytes.Buffer
+		bencode.Marshal(&buf, map[string]interface{}{
+			"msg_type":   msgData,
+			"piece":      piece,
+			"total_size": len(fp.info),
+		})
+		begin := piece * pieceSize
+		buf.Write(fp.info[begin:min(begin+pieceSize, len(fp.info))])
+		conn.Write(message.FormatExtended(utMetadataID, buf.Bytes()).Serialize())
+	}
+}
+
+func writeExtended(conn net.Conn, extendedID uint8, dict map[string]interface{}) {
+	var buf bytes.Buffer
+	bencode.Marshal(&buf, dict)
+	conn.Write(message.FormatExtended(extendedID, buf.Bytes()).Serialize())
+}
+
+func startFakePeer(t *testing.T, fp fakePeer) peers.Peer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go fp.serve(t, listener)
+	addr := listener.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestFetch(t *testing.T) {
+	// larger than one piece so the last piece is a short one
+	info := []byte("d6:lengthi1e4:name4:test12:piece lengthi16384e6:pieces" +
+		"40000:" + strings.Repeat("x", 40000) + "e")
+	infoHash := sha1.Sum(info)
+	tests := map[string]struct {
+		peer     fakePeer
+		infoHash [20]byte
+		fails    bool
+	}{
+		"downloads and verifies metadata": {
+			peer:     fakePeer{info: info, extensions: true},
+			infoHash: infoHash,
+			fails:    false,
+		},
+		"hash mismatch": {
+			peer:     fakePeer{info: info, extensions: true},
+			infoHash: sha1.Sum([]byte("something else")),
+			fails:    true,
+		},
+		"no extension protocol": {
+			peer:     fakePeer{info: info, extensions: false},
+			infoHash: infoHash,
+			fails:    true,
+		},
+		"rejected": {
+			peer:     fakePeer{info: info, extensions: true, reject: true},
+			infoHash: infoHash,
+			fails:    true,
+		},
+	}
+
+	for name, test := range tests {
+		peer := startFakePeer(t, test.peer)
+		got, err := Fetch([]peers.Peer{peer}, [20]byte{1}, test.infoHash)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			assert.Nil(t, got, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, info, got, name)
+		}
+	}
+}
+
+func TestFetchSkipsBadPeers(t *testing.T) {
+	info := []byte("d6:lengthi1e4:name4:test12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaae")
+	infoHash := sha1.Sum(info)
+	bad := startFakePeer(t, fakePeer{info: info, extensions: false})
+	good := startFakePeer(t, fakePeer{info: info, extensions: true})
+
+	got, err := Fetch([]peers.Peer{bad, good}, [20]byte{1}, infoHash)
+	assert.Nil(t, err)
+	assert.Equal(t, info, got)
+}
+
+func TestFetchNoPeers(t *testing.T) {
+	_, err := Fetch(nil, [20]byte{1}, [20]byte{2})
+	assert.NotNil(t, err)
+}
+
+func TestDecodeDict(t *testing.T) {
+	dict, rest, err := decodeDict([]byte("d8:msg_typei1e5:piecei0eeDATA"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"msg_type": int64(1), "piece": int64(0)}, dict)
+	assert.Equal(t, []byte("DATA"), rest)
+
+	_, _, err = decodeDict([]byte("li1ee"))
+	assert.NotNil(t, err)
+}
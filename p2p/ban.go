@@ -0,0 +1,177 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// maxHashFailures is how many failed pieces a peer may contribute blocks to
+// before it is banned, for when re-downloads never tell who sent the bad data.
+const maxHashFailures = 3
+
+// BanList holds the peers banned for sending bad data or breaking the
+// protocol. Torrents sharing one keep a peer banned for the whole session.
+type BanList struct {
+	mu     sync.Mutex
+	banned map[string]string
+}
+
+func NewBanList() *BanList {
+	return &BanList{banned: map[string]string{}}
+}
+
+// Ban refuses every connection with ip from now on.
+func (b *BanList) Ban(ip net.IP, reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.banned[ip.String()] = reason
+}
+
+// Banned reports whether ip is banned. A nil BanList bans nobody.
+func (b *BanList) Banned(ip net.IP) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.banned[ip.String()]
+	return ok
+}
+
+// protocolError is a message that breaks the protocol, as opposed to a
+// connection that failed.
+type protocolError struct {
+	err error
+}
+
+func (e *protocolError) Error() string {
+	return e.err.Error()
+}
+
+func (e *protocolError) Unwrap() error {
+	return e.err
+}
+
+// suspectBlock is a block of a piece that failed its hash check.
+type suspectBlock struct {
+	b      int
+	ip     net.IP
+	digest [20]byte
+}
+
+func blockData(piece []byte, b int) []byte {
+	end := (b + 1) * maxBlockSize
+	if end > len(piece) {
+		end = len(piece)
+	}
+	return piece[b*maxBlockSize : end]
+}
+
+// ban bans ip and drops the torrent's connections with it.
+func (t *Torrent) ban(ip net.IP, reason string) {
+	log.Printf("Banning %s: %s\n", ip, reason)
+	t.Bans.Ban(ip, reason)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for c := range t.clients {
+		if c.Peer().IP.Equal(ip) {
+			c.Conn.Close()
+		}
+	}
+	for key, c := range t.candidates {
+		if c.peer.IP.Equal(ip) {
+			delete(t.candidates, key)
+		}
+	}
+}
+
+// banIfViolation bans the peer of pc if err is a protocol violation.
+func (t *Torrent) banIfViolation(pc *peerConn, err error) {
+	var violation *protocolError
+	if errors.As(err, &violation) {
+		t.ban(pc.client.Peer().IP, violation.Error())
+	}
+}
+
+// hashFailed blames the peers that sent the blocks of a piece that failed its
+// hash check. A peer that sent every block is banned at once. Otherwise the
+// blocks are remembered to compare with the piece once it verifies, and peers
+// that keep contributing to failed pieces are banned anyway.
+func (t *Torrent) hashFailed(index int, piece []byte, senders []*peerConn) {
+	ips := map[string]net.IP{}
+	var suspects []suspectBlock
+	for b, pc := range senders {
+		if pc == nil {
+			continue
+		}
+		ip := pc.client.Peer().IP
+		ips[ip.String()] = ip
+		suspects = append(suspects, suspectBlock{b, ip, sha1.Sum(blockData(piece, b))})
+	}
+
+	var banned []net.IP
+	t.mu.Lock()
+	if len(ips) == 1 {
+		for _, ip := range ips {
+			banned = append(banned, ip)
+		}
+	} else {
+		if t.suspects == nil {
+			t.suspects = map[int][][]suspectBlock{}
+			t.hashFailures = map[string]int{}
+		}
+		t.suspects[index] = append(t.suspects[index], suspects)
+		for key, ip := range ips {
+			t.hashFailures[key]++
+			if t.hashFailures[key] >= maxHashFailures {
+				banned = append(banned, ip)
+			}
+		}
+	}
+	t.mu.Unlock()
+	for _, ip := range banned {
+		t.ban(ip, fmt.Sprintf("sent bad data for piece #%d", index))
+	}
+}
+
+// pieceVerified bans the peers whose blocks of a piece that failed before
+// differ from the verified data, and takes the failures back from the peers
+// whose blocks all match.
+func (t *Torrent) pieceVerified(index int, piece []byte) {
+	t.mu.Lock()
+	attempts := t.suspects[index]
+	delete(t.suspects, index)
+	t.mu.Unlock()
+
+	bad := map[string]net.IP{}
+	// blamed counts the failed attempts each peer was counted in
+	blamed := map[string]int{}
+	for _, attempt := range attempts {
+		counted := map[string]bool{}
+		for _, s := range attempt {
+			key := s.ip.String()
+			if !counted[key] {
+				counted[key] = true
+				blamed[key]++
+			}
+			if sha1.Sum(blockData(piece, s.b)) != s.digest {
+				bad[key] = s.ip
+			}
+		}
+	}
+
+	t.mu.Lock()
+	for key, n := range blamed {
+		if _, ok := bad[key]; !ok {
+			t.hashFailures[key] = max(t.hashFailures[key]-n, 0)
+		}
+	}
+	t.mu.Unlock()
+	for _, ip := range bad {
+		t.ban(ip, fmt.Sprintf("sent a corrupt block of piece #%d", index))
+	}
+}
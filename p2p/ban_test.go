@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// corrupt returns piece with its second block changed.
+func corrupt(piece []byte) []byte {
+	bad := append([]byte(nil), piece...)
+	bad[maxBlockSize] ^= 0xff
+	return bad
+}
+
+func TestBanList(t *testing.T) {
+	b := NewBanList()
+	b.Ban(net.IP{1, 2, 3, 4}, "testing")
+	assert.True(t, b.Banned(net.IP{1, 2, 3, 4}))
+	assert.True(t, b.Banned(net.ParseIP("1.2.3.4")))
+	assert.False(t, b.Banned(net.IP{1, 2, 3, 5}))
+
+	var unset *BanList
+	assert.False(t, unset.Banned(net.IP{1, 2, 3, 4}))
+}
+
+func TestSoleSenderOfBadPieceIsBanned(t *testing.T) {
+	tr := &Torrent{Bans: NewBanList()}
+	a := newTestPeerConn(t, tr, "10.0.0.1", nil, false)
+	bad := corrupt(bytes.Repeat([]byte{1}, 2*maxBlockSize))
+
+	tr.hashFailed(0, bad, []*peerConn{a, a})
+	assert.True(t, tr.Bans.Banned(a.client.Peer().IP))
+}
+
+func TestCorruptBlockIsFoundOnReverify(t *testing.T) {
+	tr := &Torrent{Bans: NewBanList()}
+	honest := newTestPeerConn(t, tr, "10.0.0.1", nil, false)
+	poisoner := newTestPeerConn(t, tr, "10.0.0.2", nil, false)
+	piece := bytes.Repeat([]byte{1}, 2*maxBlockSize)
+
+	tr.hashFailed(0, corrupt(piece), []*peerConn{honest, poisoner})
+	assert.False(t, tr.Bans.Banned(honest.client.Peer().IP), "either could be to blame")
+	assert.False(t, tr.Bans.Banned(poisoner.client.Peer().IP), "either could be to blame")
+
+	tr.pieceVerified(0, piece)
+	assert.True(t, tr.Bans.Banned(poisoner.client.Peer().IP))
+	assert.False(t, tr.Bans.Banned(honest.client.Peer().IP))
+	assert.Equal(t, 0, tr.hashFailures["10.0.0.1"])
+	assert.Empty(t, tr.suspects)
+}
+
+func TestHonestSenderIsClearedOnReverify(t *testing.T) {
+	tr := &Torrent{Bans: NewBanList()}
+	honest := newTestPeerConn(t, tr, "10.0.0.1", nil, false)
+	piece := bytes.Repeat([]byte{1}, 2*maxBlockSize)
+
+	// the honest peer shares more failed pieces than maxHashFailures, each
+	// with another poisoner, but every piece verifies in between
+	for index := 0; index < 2*maxHashFailures; index++ {
+		poisoner := newTestPeerConn(t, tr, fmt.Sprintf("10.0.1.%d", index), nil, false)
+		tr.hashFailed(index, corrupt(piece), []*peerConn{honest, poisoner})
+		tr.pieceVerified(index, piece)
+		assert.True(t, tr.Bans.Banned(poisoner.client.Peer().IP))
+	}
+	assert.False(t, tr.Bans.Banned(honest.client.Peer().IP))
+	assert.Equal(t, 0, tr.hashFailures["10.0.0.1"])
+}
+
+func TestRepeatedHashFailuresBan(t *testing.T) {
+	tr := &Torrent{Bans: NewBanList()}
+	a := newTestPeerConn(t, tr, "10.0.0.1", nil, false)
+	b := newTestPeerConn(t, tr, "10.0.0.2", nil, false)
+	bad := corrupt(bytes.Repeat([]byte{1}, 2*maxBlockSize))
+
+	// pieces that never verify cannot tell the two apart
+	for index := 0; index < maxHashFailures-1; index++ {
+		tr.hashFailed(index, bad, []*peerConn{a, b})
+	}
+	assert.False(t, tr.Bans.Banned(a.client.Peer().IP))
+	tr.hashFailed(maxHashFailures, bad, []*peerConn{a, b})
+	assert.True(t, tr.Bans.Banned(a.client.Peer().IP))
+	assert.True(t, tr.Bans.Banned(b.client.Peer().IP))
+}
+
+func TestBanIfViolation(t *testing.T) {
+	tr := &Torrent{Bans: NewBanList()}
+	flaky := newTestPeerConn(t, tr, "10.0.0.1", nil, false)
+	rogue := newTestPeerConn(t, tr, "10.0.0.2", nil, false)
+
+	tr.banIfViolation(flaky, errors.New("connection reset"))
+	tr.banIfViolation(rogue, fmt.Errorf("reading: %w", &protocolError{errors.New("have for piece #9 of 4")}))
+	assert.False(t, tr.Bans.Banned(flaky.client.Peer().IP))
+	assert.True(t, tr.Bans.Banned(rogue.client.Peer().IP))
+}
@@ -0,0 +1,188 @@
+package p2p
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	chokeInterval      = 10 * time.Second
+	optimisticInterval = 30 * time.Second
+	// uploadSlots is how many interested peers are unchoked by rate, besides
+	// the optimistic unchoke
+	uploadSlots = 4
+	// newPeerTime is how long a new connection is three times as likely to
+	// become the optimistic unchoke, so it gets pieces to trade
+	newPeerTime = time.Minute
+)
+
+func (t *Torrent) startChoker() {
+	t.chokerOnce.Do(func() {
+		t.rechoke = make(chan struct{}, 1)
+		t.chokerStop = make(chan struct{})
+		t.chokerDone = make(chan struct{})
+		go t.runChoker()
+	})
+}
+
+func (t *Torrent) stopChoker() {
+	if t.chokerStop == nil {
+		return
+	}
+	close(t.chokerStop)
+	<-t.chokerDone
+	t.chokerStop = nil
+}
+
+// wakeChoker lets the choker unchoke a newly interested peer right away when
+// a slot is free, instead of at the next round.
+func (t *Torrent) wakeChoker() {
+	select {
+	case t.rechoke <- struct{}{}:
+	default:
+	}
+}
+
+// runChoker chokes and unchokes peers tit-for-tat every chokeInterval and
+// rotates the optimistic unchoke every optimisticInterval.
+func (t *Torrent) runChoker() {
+	defer close(t.chokerDone)
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+	rounds := 0
+	for {
+		select {
+		case <-ticker.C:
+			t.chokeRound(rounds%int(optimisticInterval/chokeInterval) == 0)
+			rounds++
+		case <-t.rechoke:
+			t.fillSlots()
+		case <-t.chokerStop:
+			return
+		}
+	}
+}
+
+func (t *Torrent) peerConns() []*peerConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conns := make([]*peerConn, 0, len(t.clients))
+	for _, pc := range t.clients {
+		conns = append(conns, pc)
+	}
+	return conns
+}
+
+// chokeRound unchokes the uploadSlots interested peers we download from the
+// fastest, or upload to the fastest once we are seeding, plus the optimistic
+// unchoke, and chokes the rest.
+func (t *Torrent) chokeRound(rotate bool) {
+	seeding := t.isComplete(t.bitfield())
+	conns := t.peerConns()
+	rates := make(map[*peerConn]int64, len(conns))
+	for _, pc := range conns {
+		downloaded := pc.downloaded.Swap(0)
+		uploaded := pc.uploaded.Swap(0)
+		if seeding {
+			rates[pc] = uploaded
+		} else {
+			rates[pc] = downloaded
+		}
+	}
+	// shuffle first so peers with equal rates take turns
+	rand.Shuffle(len(conns), func(i, j int) { conns[i], conns[j] = conns[j], conns[i] })
+	sort.SliceStable(conns, func(i, j int) bool { return rates[conns[i]] > rates[conns[j]] })
+	unchoke := chooseUnchoked(conns, rates)
+
+	t.mu.Lock()
+	optimistic := t.optimistic
+	if rotate || optimistic == nil || unchoke[optimistic] {
+		optimistic = pickOptimistic(conns, unchoke, time.Now())
+	}
+	if optimistic != nil && t.clients[optimistic.client] != optimistic {
+		optimistic = nil // disconnected since
+	}
+	t.optimistic = optimistic
+	t.mu.Unlock()
+	if optimistic != nil {
+		unchoke[optimistic] = true
+	}
+
+	for _, pc := range conns {
+		if unchoke[pc] && pc.client.AmChoking() {
+			pc.client.SendUnchoke()
+		} else if !unchoke[pc] && !pc.client.AmChoking() {
+			pc.client.SendChoke()
+			pc.uploads.clear()
+		}
+	}
+}
+
+// chooseUnchoked picks the peers to unchoke from conns sorted by rate: the
+// fastest uploadSlots interested ones, and the uninterested ones faster than
+// those so they can start as soon as they become interested.
+func chooseUnchoked(conns []*peerConn, rates map[*peerConn]int64) map[*peerConn]bool {
+	unchoke := map[*peerConn]bool{}
+	downloaders := 0
+	slowest := int64(-1)
+	for _, pc := range conns {
+		if downloaders == uploadSlots {
+			break
+		}
+		if pc.client.PeerInterested() {
+			unchoke[pc] = true
+			downloaders++
+			slowest = rates[pc]
+		}
+	}
+	if downloaders < uploadSlots {
+		slowest = -1
+	}
+	for _, pc := range conns {
+		if !pc.client.PeerInterested() && rates[pc] > slowest {
+			unchoke[pc] = true
+		}
+	}
+	return unchoke
+}
+
+// pickOptimistic picks a random interested peer that is not unchoked anyway,
+// favouring new connections.
+func pickOptimistic(conns []*peerConn, unchoke map[*peerConn]bool, now time.Time) *peerConn {
+	var candidates []*peerConn
+	for _, pc := range conns {
+		if unchoke[pc] || !pc.client.PeerInterested() {
+			continue
+		}
+		candidates = append(candidates, pc)
+		if now.Sub(pc.connectedAt) < newPeerTime {
+			candidates = append(candidates, pc, pc)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// fillSlots unchokes interested peers while fewer than uploadSlots plus the
+// optimistic unchoke are.
+func (t *Torrent) fillSlots() {
+	conns := t.peerConns()
+	unchoked := 0
+	for _, pc := range conns {
+		if !pc.client.AmChoking() && pc.client.PeerInterested() {
+			unchoked++
+		}
+	}
+	for _, pc := range conns {
+		if unchoked >= uploadSlots+1 {
+			return
+		}
+		if pc.client.AmChoking() && pc.client.PeerInterested() {
+			pc.client.SendUnchoke()
+			unchoked++
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package p2p
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChooseUnchoked(t *testing.T) {
+	type peer struct {
+		rate       int64
+		interested bool
+	}
+	tests := map[string]struct {
+		peers    []peer
+		unchoked []int
+	}{
+		"fastest interested peers": {
+			peers:    []peer{{60, true}, {50, true}, {40, true}, {30, true}, {20, true}, {10, true}},
+			unchoked: []int{0, 1, 2, 3},
+		},
+		"uninterested peers faster than the slowest downloader": {
+			peers:    []peer{{100, false}, {50, true}, {40, true}, {30, true}, {25, false}, {20, true}, {10, true}, {5, false}},
+			unchoked: []int{0, 1, 2, 3, 4, 5},
+		},
+		"free slots unchoke every uninterested peer": {
+			peers:    []peer{{50, true}, {30, false}, {0, false}},
+			unchoked: []int{0, 1, 2},
+		},
+		"no peers": {},
+	}
+
+	for name, test := range tests {
+		var conns []*peerConn
+		rates := map[*peerConn]int64{}
+		for i, p := range test.peers {
+			pc := newTestPeerConn(t, nil, fmt.Sprintf("10.0.0.%d", i+1), nil, p.interested)
+			conns = append(conns, pc)
+			rates[pc] = p.rate
+		}
+		unchoke := chooseUnchoked(conns, rates)
+
+		var unchoked []int
+		for i, pc := range conns {
+			if unchoke[pc] {
+				unchoked = append(unchoked, i)
+			}
+		}
+		assert.Equal(t, test.unchoked, unchoked, name)
+	}
+}
+
+func TestPickOptimisticSkipsUnchokedAndUninterested(t *testing.T) {
+	unchoked := newTestPeerConn(t, nil, "10.0.0.1", nil, true)
+	uninterested := newTestPeerConn(t, nil, "10.0.0.2", nil, false)
+	waiting := newTestPeerConn(t, nil, "10.0.0.3", nil, true)
+	conns := []*peerConn{unchoked, uninterested, waiting}
+	unchoke := map[*peerConn]bool{unchoked: true}
+
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, waiting, pickOptimistic(conns, unchoke, time.Now()))
+	}
+	assert.Nil(t, pickOptimistic(conns[:2], unchoke, time.Now()))
+}
+
+func TestPickOptimisticFavoursNewPeers(t *testing.T) {
+	now := time.Now()
+	old := newTestPeerConn(t, nil, "10.0.0.1", nil, true)
+	old.connectedAt = now.Add(-2 * newPeerTime)
+	fresh := newTestPeerConn(t, nil, "10.0.0.2", nil, true)
+	fresh.connectedAt = now
+	conns := []*peerConn{old, fresh}
+
+	picks := 4000
+	freshPicks := 0
+	for i := 0; i < picks; i++ {
+		if pickOptimistic(conns, map[*peerConn]bool{}, now) == fresh {
+			freshPicks++
+		}
+	}
+	// three chances to one
+	assert.InDelta(t, 0.75, float64(freshPicks)/float64(picks), 0.05)
+}
@@ -0,0 +1,105 @@
+package p2p
+
+import (
+	"bittorrent_client/client"
+	"bittorrent_client/handshake"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// handoffTimeout bounds how long an accepted connection waits for its torrent
+// to pick it up.
+const handoffTimeout = 5 * time.Second
+
+// Listener accepts peer connections and hands each one to the registered
+// torrent its handshake asks for.
+type Listener struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+
+	done chan struct{}
+}
+
+func Listen(addr string) (*Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		ln:       ln,
+		torrents: map[[20]byte]*Torrent{},
+		done:     make(chan struct{}),
+	}
+	go l.serve()
+	return l, nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Register routes connections for t.InfoHash to t.Incoming.
+func (l *Listener) Register(t *Torrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.torrents[t.InfoHash] = t
+}
+
+func (l *Listener) Unregister(infoHash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.torrents, infoHash)
+}
+
+func (l *Listener) Close() error {
+	err := l.ln.Close()
+	<-l.done
+	return err
+}
+
+func (l *Listener) serve() {
+	defer close(l.done)
+	for {
+		conn, err := l.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println("Could not accept connection:", err)
+			continue
+		}
+		go l.handle(conn)
+	}
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	theirs, err := handshake.Read(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	l.mu.Lock()
+	t, ok := l.torrents[theirs.InfoHash]
+	l.mu.Unlock()
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	c, err := client.Accept(conn, theirs, t.PeerID, t.bitfield())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case t.Incoming <- c:
+	case <-time.After(handoffTimeout):
+		conn.Close()
+	}
+}
@@ -0,0 +1,77 @@
+package p2p
+
+import (
+	"bittorrent_client/client"
+	"bittorrent_client/peers"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerRoutesByInfoHash(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	addr := l.Addr().(*net.TCPAddr)
+	listening := peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+	a := &Torrent{InfoHash: [20]byte{1}, PieceHashes: make([][20]byte, 8), Completed: bitfieldOf(8), Incoming: make(chan *client.Client, 1)}
+	b := &Torrent{InfoHash: [20]byte{2}, PieceHashes: make([][20]byte, 8), Completed: bitfieldOf(8), Incoming: make(chan *client.Client, 1)}
+	l.Register(a)
+	l.Register(b)
+
+	for _, tr := range []*Torrent{a, b} {
+		c, err := client.ConnectWithPeer(listening, [20]byte{9}, tr.InfoHash, bitfieldOf(8, 3))
+		require.Nil(t, err)
+		defer c.Conn.Close()
+		select {
+		case accepted := <-tr.Incoming:
+			assert.Equal(t, bitfieldOf(8, 3), accepted.Bitfield)
+			accepted.Conn.Close()
+		case <-time.After(time.Second):
+			t.Fatal("connection did not reach its torrent")
+		}
+	}
+
+	_, err = client.ConnectWithPeer(listening, [20]byte{9}, [20]byte{3}, bitfieldOf(8))
+	assert.NotNil(t, err, "connections for unknown torrents are closed")
+	assert.Empty(t, a.Incoming)
+	assert.Empty(t, b.Incoming)
+
+	l.Unregister(a.InfoHash)
+	_, err = client.ConnectWithPeer(listening, [20]byte{9}, a.InfoHash, bitfieldOf(8))
+	assert.NotNil(t, err)
+	assert.Empty(t, a.Incoming)
+}
+
+func TestAcceptPeer(t *testing.T) {
+	tr := newSeedTorrent()
+	tr.MaxConnections = 1
+	tr.picker = newPicker(2, tr.Completed, tr.calculatePieceSize)
+	banned := newTestPeerConn(t, tr, "10.0.0.1", nil, false)
+	tr.Bans.Ban(banned.client.Peer().IP, "testing")
+
+	tr.acceptPeer(banned.client, nil)
+	assert.NotNil(t, banned.client.SendHave(0), "banned peers are closed")
+	assert.Empty(t, tr.activePeers)
+
+	// we have nothing to download, so the worker seeds to the peer and holds
+	// the slot until the connection closes
+	first := newTestPeerConn(t, tr, "10.0.0.2", nil, false)
+	tr.acceptPeer(first.client, nil)
+	tr.mu.Lock()
+	assert.True(t, tr.activePeers[first.client.Peer().String()])
+	tr.mu.Unlock()
+
+	second := newTestPeerConn(t, tr, "10.0.0.3", nil, false)
+	tr.acceptPeer(second.client, nil)
+	assert.NotNil(t, second.client.SendHave(0), "peers over the limit are closed")
+
+	tr.Close()
+	tr.mu.Lock()
+	assert.Empty(t, tr.activePeers, "the slot is freed when the worker exits")
+	tr.mu.Unlock()
+}
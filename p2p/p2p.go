@@ -1,21 +1,34 @@
 package p2p
 
 import (
+	"bittorrent_client/bitfield"
 	"bittorrent_client/client"
 	"bittorrent_client/message"
 	"bittorrent_client/peers"
+	"bittorrent_client/pex"
+	"bittorrent_client/ratelimit"
+	"bittorrent_client/storage"
 	"bytes"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"log"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const maxBackLog = 5
+// requestTimeout drops peers that leave our requests unanswered.
+const requestTimeout = 30 * time.Second
 
 const maxBlockSize = 16384
 
+const resumeInterval = 30 * time.Second
+
+// ErrStopped is returned by Download when Stop was closed.
+var ErrStopped = errors.New("download stopped")
+
 type Torrent struct {
 	Peers       []peers.Peer
 	PeerID      [20]byte
@@ -24,12 +37,68 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Storage     *storage.Storage
+	Completed   bitfield.BitField
+	ResumePath  string
+	// NewPeers delivers peers discovered while the download is running
+	NewPeers chan []peers.Peer
+	// LocalPeers delivers LAN peers, which are connected before any others
+	LocalPeers chan []peers.Peer
+	// Incoming delivers connections peers opened to us
+	Incoming chan *client.Client
+	// SeedRatio and SeedTime limit how long Seed keeps uploading
+	SeedRatio float64
+	SeedTime  time.Duration
+	// DownloadLimits and UploadLimits throttle every connection, such as a
+	// limiter of the torrent's own and one shared by all torrents
+	DownloadLimits []*ratelimit.Limiter
+	UploadLimits   []*ratelimit.Limiter
+	// MaxConnections caps the torrent's connections, defaultMaxConnections
+	// when 0, and ConnLimit caps them together with other torrents
+	MaxConnections int
+	ConnLimit      *ConnLimit
+	// Bans holds the peers we refuse to connect with
+	Bans *BanList
+	// Stop ends Download and Seed early when closed
+	Stop chan struct{}
+
+	mu sync.Mutex
+	// activePeers holds the peers with a worker, which each take a slot
+	activePeers map[string]bool
+	candidates  map[string]*candidate
+	// slotFreed wakes Download and Seed to dial candidates
+	slotFreed chan struct{}
+	connected map[string]peers.Peer
+	picker    *picker
+	clients   map[*client.Client]*peerConn
+	stopped   bool
+	workers   sync.WaitGroup
+	// done is closed once Download returned or Close ran, so workers stop
+	// handing it pieces
+	done     chan struct{}
+	doneOnce sync.Once
+	// optimistic is the peer unchoked regardless of its rate
+	optimistic *peerConn
+	rechoke    chan struct{}
+	chokerOnce sync.Once
+	chokerStop chan struct{}
+	chokerDone chan struct{}
+	// discovered carries peers learned from other peers to Download
+	discovered chan []peers.Peer
+	// suspects holds the blocks of each failed attempt at a piece until it
+	// verifies, and hashFailures counts the failed pieces each IP
+	// contributed to and was not cleared of
+	suspects     map[int][][]suspectBlock
+	hashFailures map[string]int
+	downloaded   atomic.Int64
+	uploaded     atomic.Int64
 }
 
-type workContainer struct {
-	index  int
-	hash   [20]byte
-	length int
+// Stats holds the transfer counters reported to trackers.
+type Stats struct {
+	Uploaded   int
+	Downloaded int
+	Left       int
 }
 
 type resultsContainer struct {
@@ -37,17 +106,40 @@ type resultsContainer struct {
 	buf   []byte
 }
 
-type pieceProgress struct {
-	index      int
-	client     *client.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
+// peerConn is the state of a connection shared by its worker, its uploader
+// and the choker.
+type peerConn struct {
+	torrent     *Torrent
+	client      *client.Client
+	uploads     *uploader
+	connectedAt time.Time
+	// results receives the pieces completed by blocks from this peer
+	results chan *resultsContainer
+	// waitingSince is when the peer last sent a block we are waiting for,
+	// or when we started waiting
+	waitingSince time.Time
+	// downloaded and uploaded count block bytes since the last choke round
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	// requestedAt is when each outstanding block was requested
+	requestedAt map[block]time.Time
+
+	statsMu  sync.Mutex
+	rate     float64
+	minRTT   time.Duration
+	pipeline int
+	// window accumulates the bytes of the rate sample started at windowStart
+	window      int
+	windowStart time.Time
 }
 
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.ReadMessage()
+// readMessage reads and handles the next message. Messages that break the
+// protocol are returned as a protocolError.
+func (pc *peerConn) readMessage() error {
+	msg, err := pc.client.ReadMessage()
+	if errors.Is(err, message.ErrTooLong) {
+		return &protocolError{err}
+	}
 	if err != nil {
 		return err
 	}
@@ -55,144 +147,462 @@ func (state *pieceProgress) readMessage() error {
 	if msg == nil {
 		return nil
 	}
+	err = pc.handleMessage(msg)
+	if err != nil {
+		return &protocolError{err}
+	}
+	return nil
+}
 
+func (pc *peerConn) handleMessage(msg *message.Message) error {
+	t := pc.torrent
 	switch msg.ID {
 	case message.MsgUnchoke:
-		state.client.Choked = false
+		pc.client.Choked = false
 	case message.MsgChoke:
-		state.client.Choked = true
+		// requests are dropped on choke, let other peers have the blocks
+		pc.client.Choked = true
+		t.picker.releasePeer(pc)
 	case message.MsgHave:
 		index, err := message.ParseHave(msg)
 		if err != nil {
 			return err
 		}
-		state.client.Bitfield.SetPiece(index)
+		if index >= len(t.PieceHashes) {
+			return fmt.Errorf("have for piece #%d of %d", index, len(t.PieceHashes))
+		}
+		if !pc.client.Bitfield.HasPiece(index) {
+			pc.client.Bitfield.SetPiece(index)
+			if pc.client.Bitfield.HasPiece(index) {
+				t.picker.peerHas(index)
+			}
+		}
+	case message.MsgInterested:
+		t.wakeChoker()
+	case message.MsgRequest:
+		return pc.uploads.request(msg)
+	case message.MsgCancel:
+		return pc.uploads.cancel(msg)
 	case message.MsgPiece:
-		downloaded, err := message.ParsePiece(state.index, state.buf, msg)
+		return pc.receiveBlock(msg)
+	case message.MsgExtended:
+		name, payload, err := pc.client.ReadExtended(msg)
+		if err != nil {
+			return err
+		}
+		if name == pex.ExtensionName {
+			t.receivePex(payload)
+		}
+	}
+	return nil
+}
+
+// receiveBlock stores a block, cancels it at the other peers it was requested
+// from in endgame, and passes the piece on once it is complete and verified.
+func (pc *peerConn) receiveBlock(msg *message.Message) error {
+	t := pc.torrent
+	index, begin, data, err := message.ParseBlock(msg)
+	if err != nil {
+		return err
+	}
+	if index >= len(t.PieceHashes) {
+		return fmt.Errorf("block of piece #%d of %d", index, len(t.PieceHashes))
+	}
+	cancel, piece, err := t.picker.received(pc, index, begin, data)
+	if err != nil {
+		return err
+	}
+	pc.downloaded.Add(int64(len(data)))
+	pc.waitingSince = time.Now()
+	b := block{index, begin, len(data)}
+	if requestedAt, ok := pc.requestedAt[b]; ok {
+		pc.recordBlock(len(data), pc.waitingSince.Sub(requestedAt), pc.waitingSince)
+		delete(pc.requestedAt, b)
+	}
+	for _, other := range cancel {
+		go other.client.SendCancel(index, begin, len(data))
+	}
+	if piece == nil {
+		return nil
+	}
+
+	err = checkIntegrity(index, t.PieceHashes[index], piece)
+	if err != nil {
+		log.Printf("Piece #%d failed integrity check\n", index)
+		t.hashFailed(index, piece, t.picker.failed(index))
+		return nil
+	}
+	t.pieceVerified(index, piece)
+	select {
+	case pc.results <- &resultsContainer{index, piece}:
+	case <-t.doneCh():
+	}
+	return nil
+}
+
+// requestBlocks keeps the pipeline full of blocks requested from the peer.
+func (pc *peerConn) requestBlocks() error {
+	t := pc.torrent
+	outstanding := t.picker.outstanding(pc)
+	if outstanding == 0 {
+		// whatever is left was cancelled or dropped by a choke
+		pc.requestedAt = map[block]time.Time{}
+	}
+	depth := pc.pipelineDepth()
+	if outstanding >= depth {
+		return nil
+	}
+	blocks := t.picker.pickBlocks(pc, pc.client.Bitfield, depth-outstanding)
+	now := time.Now()
+	if len(blocks) > 0 && outstanding == 0 {
+		pc.waitingSince = now
+	}
+	for _, b := range blocks {
+		err := pc.client.SendRequest(b.index, b.begin, b.length)
 		if err != nil {
 			return err
 		}
-		state.downloaded += downloaded
-		state.backlog--
+		pc.requestedAt[b] = now
 	}
 	return nil
 }
 
-func (t Torrent) calculatePieceSize(index int) int {
+func (t *Torrent) calculatePieceSize(index int) int {
 	begin := index * t.PieceLength
 	end := begin + t.PieceLength
+	if end > t.Length {
+		end = t.Length
+	}
 	return end - begin
 }
 
-func attemptDownloadPiece(client *client.Client, workPiece *workContainer) ([]byte, error) {
-	state := pieceProgress{
-		index:  workPiece.index,
-		client: client,
-		buf:    make([]byte, workPiece.length),
+func checkIntegrity(index int, hash [20]byte, buf []byte) error {
+	hashedBuf := sha1.Sum(buf)
+	if !bytes.Equal(hashedBuf[:], hash[:]) {
+		return fmt.Errorf("index %d failed integrity check", index)
 	}
+	return nil
+}
 
-	client.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer client.Conn.SetDeadline(time.Time{})
+// bitfield returns a copy of the pieces we have.
+func (t *Torrent) bitfield() bitfield.BitField {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bf := make(bitfield.BitField, (len(t.PieceHashes)+7)/8)
+	copy(bf, t.Completed)
+	return bf
+}
 
-	for state.downloaded < workPiece.length {
-		if !state.client.Choked {
-			for state.backlog < maxBackLog && state.requested < workPiece.length {
-				blockSize := maxBlockSize
-				if workPiece.length-state.requested < blockSize {
-					blockSize = workPiece.length - state.requested
-				}
-				err := state.client.SendRequest(workPiece.index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
-			}
+func (t *Torrent) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	left := t.Length
+	for index := range t.PieceHashes {
+		if t.Completed.HasPiece(index) {
+			left -= t.calculatePieceSize(index)
 		}
+	}
+	return Stats{
+		Uploaded:   int(t.uploaded.Load()),
+		Downloaded: int(t.downloaded.Load()),
+		Left:       left,
+	}
+}
 
-		err := state.readMessage()
-		if err != nil {
-			return nil, err
+// isLAN reports whether peer is on the local network.
+func isLAN(peer peers.Peer) bool {
+	return peer.IP.IsPrivate() || peer.IP.IsLoopback() || peer.IP.IsLinkLocalUnicast()
+}
+
+func (t *Torrent) disconnectPeer(peer peers.Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.activePeers, peer.String())
+	delete(t.connected, peer.String())
+	t.ConnLimit.release()
+	select {
+	case t.slotFreed <- struct{}{}:
+	default:
+	}
+}
+
+func (t *Torrent) markConnected(peer peers.Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.connected == nil {
+		t.connected = map[string]peers.Peer{}
+	}
+	t.connected[peer.String()] = peer
+}
+
+func (t *Torrent) markDisconnected(peer peers.Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.connected, peer.String())
+}
+
+// connectedPeers lists the peers we have a connection with, except skip.
+func (t *Torrent) connectedPeers(skip peers.Peer) []peers.Peer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ps := make([]peers.Peer, 0, len(t.connected))
+	for key, peer := range t.connected {
+		if key != skip.String() {
+			ps = append(ps, peer)
 		}
 	}
+	return ps
+}
 
-	return state.buf, nil
+// sendPex tells the peer about changes to our connections if it negotiated
+// ut_pex and the last message is old enough.
+func (t *Torrent) sendPex(client *client.Client, sender *pex.Sender, peer peers.Peer) {
+	if !client.SupportsExtension(pex.ExtensionName) {
+		return
+	}
+	m, ok := sender.Next(t.connectedPeers(peer), time.Now())
+	if !ok {
+		return
+	}
+	payload, err := m.Serialize()
+	if err != nil {
+		return
+	}
+	client.SendExtended(pex.ExtensionName, payload)
 }
 
-func checkIntegrity(workpiece *workContainer, buf []byte) error {
-	hashedBuf := sha1.Sum(buf)
-	if !bytes.Equal(hashedBuf[:], workpiece.hash[:]) {
-		return fmt.Errorf("index %d failed integrity check", workpiece.index)
+// receivePex passes the peers a ut_pex message added on to Download. Peers
+// are dropped rather than blocking the connection when Download is busy.
+func (t *Torrent) receivePex(payload []byte) {
+	m, err := pex.Parse(payload)
+	if err != nil {
+		log.Println("Ignoring malformed pex message:", err)
+		return
+	}
+	if len(m.Added) == 0 {
+		return
+	}
+	select {
+	case t.discovered <- m.Added:
+	default:
 	}
-	return nil
 }
 
-func (t Torrent) downloadPiece(peer peers.Peer, workBuf chan *workContainer, results chan *resultsContainer) {
-	client, err := client.ConnectWithPeer(peer, t.PeerID, t.InfoHash)
+func (t *Torrent) downloadPiece(peer peers.Peer, results chan *resultsContainer) {
+	defer t.workers.Done()
+	defer t.disconnectPeer(peer)
+	client, err := client.ConnectWithPeer(peer, t.PeerID, t.InfoHash, t.bitfield())
 	if err != nil {
 		log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
+		t.redialLater(peer, false, false)
 		return
 	}
-	defer client.Conn.Close()
 	log.Printf("Completed handshake with %s\n", peer.IP)
+	t.markConnected(peer)
+	t.servePeer(client, results)
+	t.redialLater(peer, true, t.isComplete(client.Bitfield))
+}
 
-	client.SendUnchoke()
-	client.SendInterested()
+// acceptPeer starts a worker for a connection the peer opened.
+func (t *Torrent) acceptPeer(c *client.Client, results chan *resultsContainer) {
+	peer := c.Peer()
+	if t.Bans.Banned(peer.IP) {
+		log.Printf("Rejecting connection from banned %s\n", peer.IP)
+		c.Conn.Close()
+		return
+	}
+	if !t.takeSlot(peer) {
+		log.Printf("Rejecting connection from %s, too many connections\n", peer.IP)
+		c.Conn.Close()
+		return
+	}
+	log.Printf("Accepted connection from %s\n", peer.IP)
 
-	for workPiece := range workBuf {
-		if !client.Bitfield.HasPiece(workPiece.index) {
-			workBuf <- workPiece
-			continue
+	// the remote port is ephemeral, only the one from the extended handshake
+	// is worth sharing over pex
+	shared := peer
+	if c.Extended != nil && c.Extended.Port > 0 {
+		shared = peers.Peer{IP: peer.IP, Port: uint16(c.Extended.Port)}
+		t.markConnected(shared)
+	}
+	t.workers.Add(1)
+	go func() {
+		defer t.workers.Done()
+		defer t.disconnectPeer(peer)
+		defer t.markDisconnected(shared)
+		t.servePeer(c, results)
+	}()
+}
+
+// servePeer downloads the blocks the picker hands out from the peer until
+// the download is finished, then seeds to it, while answering its requests
+// throughout.
+func (t *Torrent) servePeer(client *client.Client, results chan *resultsContainer) {
+	defer client.Conn.Close()
+	if len(t.DownloadLimits) > 0 || len(t.UploadLimits) > 0 {
+		client.Conn = ratelimit.NewConn(client.Conn, t.DownloadLimits, t.UploadLimits)
+	}
+	pc := &peerConn{torrent: t, client: client, connectedAt: time.Now(), results: results}
+	pc.uploads = newUploader(t, pc)
+	defer pc.uploads.close()
+	if !t.addPeerConn(pc) {
+		return
+	}
+	defer t.removePeerConn(pc)
+	t.picker.addPeer(client.Bitfield)
+	defer func() { t.picker.removePeer(client.Bitfield) }()
+	defer t.picker.releasePeer(pc)
+
+	var pexSender pex.Sender
+	interested := false
+	for !t.picker.finished() {
+		t.sendPex(client, &pexSender, client.Peer())
+		if !client.Choked {
+			err := pc.requestBlocks()
+			if err != nil {
+				log.Println("Exiting", err)
+				return
+			}
 		}
 
-		buf, err := attemptDownloadPiece(client, workPiece)
+		if t.picker.outstanding(pc) > 0 {
+			client.Conn.SetReadDeadline(pc.waitingSince.Add(requestTimeout))
+		} else {
+			if wanted := t.picker.interesting(client.Bitfield); wanted != interested {
+				if wanted {
+					client.SendInterested()
+				} else {
+					client.SendNotInterested()
+				}
+				interested = wanted
+			}
+			client.Conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+		err := pc.readMessage()
 		if err != nil {
 			log.Println("Exiting", err)
-			workBuf <- workPiece
+			t.banIfViolation(pc, err)
 			return
 		}
+	}
+	if interested {
+		client.SendNotInterested()
+	}
+	t.seedPeer(pc, &pexSender)
+}
 
-		err = checkIntegrity(workPiece, buf)
-		if err != nil {
-			log.Printf("Piece #%d failed integrity check\n", workPiece.index)
-			workBuf <- workPiece
-			continue
-		}
-
-		client.SendHave(workPiece.index)
+func (t *Torrent) saveResume() {
+	if t.ResumePath == "" {
+		return
+	}
+	err := t.Storage.SaveResume(t.ResumePath, t.Completed, len(t.PieceHashes))
+	if err != nil {
+		log.Println("Could not save resume data:", err)
+	}
+}
 
-		results <- &resultsContainer{workPiece.index, buf}
+// doneCh returns the channel markDone closes.
+func (t *Torrent) doneCh() chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done == nil {
+		t.done = make(chan struct{})
 	}
+	return t.done
 }
 
-func (t Torrent) Download() ([]byte, error) {
+// markDone tells the workers that nobody receives their pieces anymore.
+func (t *Torrent) markDone() {
+	done := t.doneCh()
+	t.doneOnce.Do(func() { close(done) })
+}
+
+func (t *Torrent) Download() error {
 	log.Println("Downloading", t.Name)
-	workBuf := make(chan *workContainer, len(t.PieceHashes))
 	results := make(chan *resultsContainer)
+	defer t.markDone()
 
-	for index, hash := range t.PieceHashes {
-		length := t.calculatePieceSize(index)
-		workBuf <- &workContainer{index, hash, length}
+	t.picker = newPicker(len(t.PieceHashes), t.Completed, t.calculatePieceSize)
+	missing := t.picker.left
+	if missing < len(t.PieceHashes) {
+		log.Printf("Resuming with %d of %d pieces already downloaded\n", len(t.PieceHashes)-missing, len(t.PieceHashes))
+	}
+	if missing == 0 {
+		return nil
 	}
+	t.startChoker()
 
-	for _, peer := range t.Peers {
-		go t.downloadPiece(peer, workBuf, results)
+	t.discovered = make(chan []peers.Peer, 16)
+	t.slotFreed = make(chan struct{}, 1)
+	if t.Bans == nil {
+		t.Bans = NewBanList()
 	}
+	t.addCandidates(t.Peers)
+	t.dialCandidates(results)
 
-	buf := make([]byte, t.Length)
-	downloadedPiece := 0
+	resumeTicker := time.NewTicker(resumeInterval)
+	defer resumeTicker.Stop()
+	dialTicker := time.NewTicker(dialInterval)
+	defer dialTicker.Stop()
+
+	downloadedPiece := len(t.PieceHashes) - missing
 	for downloadedPiece < len(t.PieceHashes) {
-		res := <-results
+		select {
+		case ps := <-t.LocalPeers:
+			t.addCandidates(ps)
+			t.dialCandidates(results)
+			continue
+		default:
+		}
+
+		var res *resultsContainer
+		select {
+		case res = <-results:
+		case ps := <-t.LocalPeers:
+			t.addCandidates(ps)
+			t.dialCandidates(results)
+			continue
+		case ps := <-t.NewPeers:
+			t.addCandidates(ps)
+			t.dialCandidates(results)
+			continue
+		case ps := <-t.discovered:
+			t.addCandidates(ps)
+			t.dialCandidates(results)
+			continue
+		case <-t.slotFreed:
+			t.dialCandidates(results)
+			continue
+		case <-dialTicker.C:
+			t.dialCandidates(results)
+			continue
+		case c := <-t.Incoming:
+			t.acceptPeer(c, results)
+			continue
+		case <-resumeTicker.C:
+			t.saveResume()
+			continue
+		case <-t.Stop:
+			return ErrStopped
+		}
 		begin := res.index * t.PieceLength
-		end := begin + t.PieceLength
-		copy(buf[begin:end], res.buf)
+		_, err := t.Storage.WriteAt(res.buf, int64(begin))
+		if err != nil {
+			return err
+		}
+		t.mu.Lock()
+		t.Completed.SetPiece(res.index)
+		t.mu.Unlock()
+		t.picker.done(res.index)
+		t.broadcastHave(res.index)
+		t.downloaded.Add(int64(len(res.buf)))
 		downloadedPiece++
 
 		percent := float64(downloadedPiece) / float64(len(t.PieceHashes)) * 100
 		numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread
 		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
 	}
-	close(workBuf)
+	t.saveResume()
 
-	return buf, nil
+	return nil
 }
@@ -0,0 +1,67 @@
+package p2p
+
+import (
+	"bittorrent_client/bitfield"
+	"bittorrent_client/client"
+	"bittorrent_client/handshake"
+	"bittorrent_client/message"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// pipeConn is one end of a net.Pipe posing as a TCP connection from addr.
+type pipeConn struct {
+	net.Conn
+	addr *net.TCPAddr
+}
+
+func (c pipeConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// newTestPeerConn connects tr with a peer at ip that has the pieces in bf and
+// is interested in us if interested is set. The peer ignores what we send.
+func newTestPeerConn(t *testing.T, tr *Torrent, ip string, bf bitfield.BitField, interested bool) *peerConn {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	go io.Copy(io.Discard, remote)
+	go func() {
+		remote.Write((&message.Message{ID: message.MsgBitfield, Payload: bf}).Serialize())
+		if interested {
+			remote.Write((&message.Message{ID: message.MsgInterested}).Serialize())
+		}
+	}()
+
+	conn := pipeConn{Conn: local, addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 6881}}
+	c, err := client.Accept(conn, handshake.New([20]byte{}, [20]byte{}), [20]byte{}, nil)
+	require.Nil(t, err)
+	if interested {
+		_, err = c.ReadMessage()
+		require.Nil(t, err)
+	}
+	return &peerConn{torrent: tr, client: c, connectedAt: time.Now()}
+}
+
+// peerSends makes the peer of pc send msgs next, in place of whatever its
+// connection had left to send.
+func peerSends(t *testing.T, pc *peerConn, msgs ...*message.Message) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	go io.Copy(io.Discard, remote)
+	go func() {
+		for _, msg := range msgs {
+			remote.Write(msg.Serialize())
+		}
+	}()
+	pc.client.Conn = pipeConn{Conn: local, addr: pc.client.Conn.RemoteAddr().(*net.TCPAddr)}
+}
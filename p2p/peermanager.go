@@ -0,0 +1,197 @@
+package p2p
+
+import (
+	"bittorrent_client/peers"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMaxConnections caps the connections of a torrent that does not
+	// set MaxConnections
+	defaultMaxConnections = 50
+	// redialDelay is how long to wait before redialing a peer whose
+	// connection dropped; every failed dial in a row doubles it
+	redialDelay    = 15 * time.Second
+	maxRedialDelay = 10 * time.Minute
+	// maxDialFailures is how many dials in a row may fail before the peer is
+	// forgotten
+	maxDialFailures = 5
+	// dialInterval is how often candidates whose backoff ran out are dialed
+	dialInterval = 5 * time.Second
+)
+
+// ConnLimit caps the connections of every torrent sharing it. A nil ConnLimit
+// or one with a max of 0 does not limit.
+type ConnLimit struct {
+	mu   sync.Mutex
+	max  int
+	open int
+}
+
+func NewConnLimit(max int) *ConnLimit {
+	return &ConnLimit{max: max}
+}
+
+// SetMax changes the cap. Connections above it stay open, but no new ones are
+// made until enough of them closed.
+func (l *ConnLimit) SetMax(max int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max = max
+}
+
+// acquire takes a connection slot, reporting false if none is free.
+func (l *ConnLimit) acquire() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.open >= l.max {
+		return false
+	}
+	l.open++
+	return true
+}
+
+func (l *ConnLimit) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.open--
+}
+
+// candidate is a peer we know of and may dial.
+type candidate struct {
+	peer peers.Peer
+	// failures counts the dials in a row that failed
+	failures int
+	// seed is set when the peer had every piece when it last disconnected
+	seed     bool
+	nextDial time.Time
+}
+
+// redialBackoff is how long to wait before dialing a peer again after
+// failures failed dials in a row.
+func redialBackoff(failures int) time.Duration {
+	delay := redialDelay
+	for i := 1; i < failures && delay < maxRedialDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRedialDelay {
+		delay = maxRedialDelay
+	}
+	return delay
+}
+
+func (t *Torrent) maxConnections() int {
+	if t.MaxConnections > 0 {
+		return t.MaxConnections
+	}
+	return defaultMaxConnections
+}
+
+// addCandidates adds peers from trackers, pex, the DHT or the LAN to the pool
+// of peers to dial. Peers already in it keep their backoff, banned peers are
+// left out.
+func (t *Torrent) addCandidates(ps []peers.Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.candidates == nil {
+		t.candidates = map[string]*candidate{}
+	}
+	for _, peer := range ps {
+		if t.Bans.Banned(peer.IP) {
+			continue
+		}
+		if _, ok := t.candidates[peer.String()]; !ok {
+			t.candidates[peer.String()] = &candidate{peer: peer}
+		}
+	}
+}
+
+// readyCandidates lists the candidates that are not connected and not backing
+// off in the order to dial them, LAN peers first. Seeds are left out once we
+// are complete too. t.mu must be held.
+func (t *Torrent) readyCandidates(now time.Time) []*candidate {
+	complete := t.isComplete(t.Completed)
+	var ready []*candidate
+	for key, c := range t.candidates {
+		if t.activePeers[key] || now.Before(c.nextDial) || (complete && c.seed) {
+			continue
+		}
+		ready = append(ready, c)
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		if isLAN(ready[i].peer) != isLAN(ready[j].peer) {
+			return isLAN(ready[i].peer)
+		}
+		return ready[i].failures < ready[j].failures
+	})
+	return ready
+}
+
+// dialCandidates starts workers for the ready candidates while the torrent and
+// the global limit have free slots.
+func (t *Torrent) dialCandidates(results chan *resultsContainer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	if t.activePeers == nil {
+		t.activePeers = map[string]bool{}
+	}
+	for _, c := range t.readyCandidates(time.Now()) {
+		if len(t.activePeers) >= t.maxConnections() || !t.ConnLimit.acquire() {
+			return
+		}
+		t.activePeers[c.peer.String()] = true
+		t.workers.Add(1)
+		go t.downloadPiece(c.peer, results)
+	}
+}
+
+// redialLater schedules the next dial of a candidate whose worker is exiting,
+// or forgets it after too many failed dials. connected tells whether the
+// handshake succeeded and seed whether the peer had every piece.
+func (t *Torrent) redialLater(peer peers.Peer, connected, seed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.candidates[peer.String()]
+	if !ok {
+		return
+	}
+	if connected {
+		c.failures = 0
+		c.seed = seed
+	} else {
+		c.failures++
+	}
+	if c.failures >= maxDialFailures {
+		log.Printf("Forgetting %s after %d failed dials\n", peer.IP, c.failures)
+		delete(t.candidates, peer.String())
+		return
+	}
+	c.nextDial = time.Now().Add(redialBackoff(c.failures))
+}
+
+// takeSlot reserves a slot for a connection the peer opened, reporting false
+// if the torrent or the global limit is full.
+func (t *Torrent) takeSlot(peer peers.Peer) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.activePeers == nil {
+		t.activePeers = map[string]bool{}
+	}
+	if len(t.activePeers) >= t.maxConnections() || !t.ConnLimit.acquire() {
+		return false
+	}
+	t.activePeers[peer.String()] = true
+	return true
+}
@@ -0,0 +1,195 @@
+package p2p
+
+import (
+	"bittorrent_client/peers"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedialBackoff(t *testing.T) {
+	tests := map[string]struct {
+		failures int
+		output   time.Duration
+	}{
+		"dropped connection": {failures: 0, output: redialDelay},
+		"one failed dial":    {failures: 1, output: redialDelay},
+		"two failed dials":   {failures: 2, output: 2 * redialDelay},
+		"three failed dials": {failures: 3, output: 4 * redialDelay},
+		"capped":             {failures: 7, output: maxRedialDelay},
+		"capped far past it": {failures: 40, output: maxRedialDelay},
+		"just under the cap": {failures: 6, output: 32 * redialDelay},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.output, redialBackoff(test.failures), name)
+	}
+}
+
+func TestRedialLaterForgetsFailingPeers(t *testing.T) {
+	tr := &Torrent{}
+	peer := peers.Peer{IP: net.IP{1, 2, 3, 4}, Port: 6881}
+	tr.addCandidates([]peers.Peer{peer})
+
+	tr.redialLater(peer, false, false)
+	tr.redialLater(peer, true, false)
+	c := tr.candidates[peer.String()]
+	require.NotNil(t, c)
+	assert.Equal(t, 0, c.failures, "a connection resets the failures")
+	assert.WithinDuration(t, time.Now().Add(redialDelay), c.nextDial, time.Second)
+
+	for i := 1; i < maxDialFailures; i++ {
+		tr.redialLater(peer, false, false)
+		assert.Equal(t, i, c.failures)
+	}
+	assert.WithinDuration(t, time.Now().Add(redialBackoff(maxDialFailures-1)), c.nextDial, time.Second)
+	tr.redialLater(peer, false, false)
+	assert.NotContains(t, tr.candidates, peer.String())
+
+	// peers the torrent never dialed are left alone
+	tr.redialLater(peers.Peer{IP: net.IP{5, 6, 7, 8}, Port: 1}, false, false)
+	assert.Empty(t, tr.candidates)
+}
+
+func TestReadyCandidates(t *testing.T) {
+	public := peers.Peer{IP: net.IP{1, 2, 3, 4}, Port: 1}
+	failing := peers.Peer{IP: net.IP{1, 2, 3, 5}, Port: 1}
+	lan := peers.Peer{IP: net.IP{192, 168, 1, 2}, Port: 1}
+	connected := peers.Peer{IP: net.IP{1, 2, 3, 6}, Port: 1}
+	waiting := peers.Peer{IP: net.IP{1, 2, 3, 7}, Port: 1}
+	seed := peers.Peer{IP: net.IP{1, 2, 3, 8}, Port: 1}
+
+	tr := &Torrent{PieceHashes: make([][20]byte, 1), Completed: bitfieldOf(1)}
+	tr.addCandidates([]peers.Peer{failing, public, connected, waiting, seed, lan})
+	tr.candidates[failing.String()].failures = 2
+	tr.candidates[waiting.String()].nextDial = time.Now().Add(time.Minute)
+	tr.candidates[seed.String()].seed = true
+	tr.activePeers = map[string]bool{connected.String(): true}
+
+	var order []peers.Peer
+	for _, c := range tr.readyCandidates(time.Now()) {
+		order = append(order, c.peer)
+	}
+	// peers that tie come in any order
+	assert.ElementsMatch(t, []peers.Peer{lan, public, seed, failing}, order)
+	assert.Equal(t, lan, order[0])
+	assert.Equal(t, failing, order[len(order)-1])
+
+	// seeds are of no use once we are complete
+	tr.Completed.SetPiece(0)
+	order = nil
+	for _, c := range tr.readyCandidates(time.Now()) {
+		order = append(order, c.peer)
+	}
+	assert.Equal(t, []peers.Peer{lan, public, failing}, order)
+}
+
+func TestConnLimit(t *testing.T) {
+	l := NewConnLimit(2)
+	assert.True(t, l.acquire())
+	assert.True(t, l.acquire())
+	assert.False(t, l.acquire())
+	l.release()
+	assert.True(t, l.acquire())
+
+	l.SetMax(0)
+	assert.True(t, l.acquire(), "0 does not limit")
+
+	var unset *ConnLimit
+	assert.True(t, unset.acquire())
+	unset.release()
+}
+
+func TestTakeSlot(t *testing.T) {
+	global := NewConnLimit(3)
+	a := &Torrent{MaxConnections: 2, ConnLimit: global}
+	b := &Torrent{MaxConnections: 2, ConnLimit: global}
+	peer := func(i byte) peers.Peer { return peers.Peer{IP: net.IP{1, 2, 3, i}, Port: 1} }
+
+	assert.True(t, a.takeSlot(peer(1)))
+	assert.True(t, a.takeSlot(peer(2)))
+	assert.False(t, a.takeSlot(peer(3)), "a is full")
+	assert.True(t, b.takeSlot(peer(4)))
+	assert.False(t, b.takeSlot(peer(5)), "all torrents together are full")
+
+	a.disconnectPeer(peer(1))
+	assert.True(t, b.takeSlot(peer(5)))
+}
+
+// holdingListener accepts connections and never answers them.
+type holdingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newHoldingListener(t *testing.T) *holdingListener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	h := &holdingListener{Listener: ln}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			h.mu.Lock()
+			h.conns = append(h.conns, c)
+			h.mu.Unlock()
+		}
+	}()
+	return h
+}
+
+func (h *holdingListener) peer() peers.Peer {
+	return peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: uint16(h.Addr().(*net.TCPAddr).Port)}
+}
+
+func (h *holdingListener) close() {
+	h.Listener.Close()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, c := range h.conns {
+		c.Close()
+	}
+}
+
+func TestDialCandidatesRespectsLimits(t *testing.T) {
+	global := NewConnLimit(3)
+	a := &Torrent{MaxConnections: 2, ConnLimit: global, PieceHashes: make([][20]byte, 1), Completed: bitfieldOf(1)}
+	b := &Torrent{MaxConnections: 5, ConnLimit: global, PieceHashes: make([][20]byte, 1), Completed: bitfieldOf(1)}
+	var listeners []*holdingListener
+	for i := 0; i < 6; i++ {
+		listeners = append(listeners, newHoldingListener(t))
+	}
+	for i, ln := range listeners {
+		if i < 3 {
+			a.addCandidates([]peers.Peer{ln.peer()})
+		} else {
+			b.addCandidates([]peers.Peer{ln.peer()})
+		}
+	}
+
+	a.dialCandidates(nil)
+	b.dialCandidates(nil)
+	a.mu.Lock()
+	assert.Len(t, a.activePeers, 2, "the torrent's limit")
+	a.mu.Unlock()
+	b.mu.Lock()
+	assert.Len(t, b.activePeers, 1, "what the global limit leaves")
+	b.mu.Unlock()
+
+	// failed handshakes free the slots
+	for _, ln := range listeners {
+		ln.close()
+	}
+	a.workers.Wait()
+	b.workers.Wait()
+	assert.Empty(t, a.activePeers)
+	assert.Empty(t, b.activePeers)
+	assert.True(t, global.acquire())
+}
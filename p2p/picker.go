@@ -0,0 +1,372 @@
+package p2p
+
+import (
+	"bittorrent_client/bitfield"
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// randomFirstPieces is how many pieces are picked at random before switching
+// to rarest first, so a fresh download quickly has something to trade.
+const randomFirstPieces = 4
+
+// block is a request-sized part of a piece.
+type block struct {
+	index  int
+	begin  int
+	length int
+}
+
+// partialPiece is a piece we started downloading. Its blocks may come from
+// different peers, and received blocks are kept when the peer that sent them
+// goes away.
+type partialPiece struct {
+	buf      []byte
+	received []bool
+	// requesters lists the peers each block is requested from
+	requesters [][]*peerConn
+	// senders holds the peer whose data each received block is
+	senders []*peerConn
+	left    int
+}
+
+// picker decides which blocks each peer downloads next. Peers finish the
+// partial pieces they can help with before starting the rarest piece among
+// the connected peers. Once every missing block is requested it enters
+// endgame and requests blocks from more peers, so the last pieces do not wait
+// for the slowest peer.
+type picker struct {
+	mu        sync.Mutex
+	pieceSize func(index int) int
+	// availability counts the connected peers that have each piece
+	availability []int
+	missing      []bool
+	partial      map[int]*partialPiece
+	// requests counts the blocks requested from each peer
+	requests map[*peerConn]int
+	left     int
+	have     int
+}
+
+func newPicker(numPieces int, completed bitfield.BitField, pieceSize func(index int) int) *picker {
+	p := &picker{
+		pieceSize:    pieceSize,
+		availability: make([]int, numPieces),
+		missing:      make([]bool, numPieces),
+		partial:      map[int]*partialPiece{},
+		requests:     map[*peerConn]int{},
+	}
+	for index := range p.missing {
+		if completed.HasPiece(index) {
+			p.have++
+		} else {
+			p.missing[index] = true
+			p.left++
+		}
+	}
+	return p
+}
+
+// addPeer counts the pieces of a newly connected peer.
+func (p *picker) addPeer(bf bitfield.BitField) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for index := range p.availability {
+		if bf.HasPiece(index) {
+			p.availability[index]++
+		}
+	}
+}
+
+// removePeer forgets the pieces of a peer that disconnected.
+func (p *picker) removePeer(bf bitfield.BitField) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for index := range p.availability {
+		if bf.HasPiece(index) {
+			p.availability[index]--
+		}
+	}
+}
+
+// peerHas counts a piece a connected peer announced with Have.
+func (p *picker) peerHas(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+func (p *picker) outstanding(pc *peerConn) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.requests[pc]
+}
+
+// pickBlocks assigns up to n blocks to request from pc, whose pieces are bf.
+func (p *picker) pickBlocks(pc *peerConn, bf bitfield.BitField, n int) []block {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var blocks []block
+	for index, piece := range p.partial {
+		if bf.HasPiece(index) {
+			blocks = p.takeBlocks(pc, index, piece, n-len(blocks), blocks)
+		}
+	}
+	for len(blocks) < n {
+		index, ok := p.pickPiece(bf)
+		if !ok {
+			break
+		}
+		piece := p.startPiece(index)
+		blocks = p.takeBlocks(pc, index, piece, n-len(blocks), blocks)
+	}
+	if len(blocks) == 0 && p.endgame() {
+		blocks = p.pickEndgame(pc, bf, n)
+	}
+	return blocks
+}
+
+// takeBlocks appends up to n blocks of piece nobody requested yet.
+func (p *picker) takeBlocks(pc *peerConn, index int, piece *partialPiece, n int, blocks []block) []block {
+	for b := range piece.received {
+		if n == 0 {
+			break
+		}
+		if piece.received[b] || len(piece.requesters[b]) > 0 {
+			continue
+		}
+		blocks = append(blocks, p.request(pc, index, piece, b))
+		n--
+	}
+	return blocks
+}
+
+func (p *picker) request(pc *peerConn, index int, piece *partialPiece, b int) block {
+	piece.requesters[b] = append(piece.requesters[b], pc)
+	p.requests[pc]++
+	begin := b * maxBlockSize
+	length := maxBlockSize
+	if begin+length > len(piece.buf) {
+		length = len(piece.buf) - begin
+	}
+	return block{index, begin, length}
+}
+
+// pickPiece chooses the next piece to start among those bf has. Ties between
+// the rarest pieces are broken at random.
+func (p *picker) pickPiece(bf bitfield.BitField) (int, bool) {
+	var candidates []int
+	rarest := 0
+	for index, missing := range p.missing {
+		if !missing || p.partial[index] != nil || !bf.HasPiece(index) {
+			continue
+		}
+		if p.have < randomFirstPieces {
+			candidates = append(candidates, index)
+			continue
+		}
+		switch {
+		case len(candidates) == 0 || p.availability[index] < rarest:
+			candidates = append(candidates[:0], index)
+			rarest = p.availability[index]
+		case p.availability[index] == rarest:
+			candidates = append(candidates, index)
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	return candidates[rand.Intn(len(candidates))], true
+}
+
+func (p *picker) startPiece(index int) *partialPiece {
+	size := p.pieceSize(index)
+	numBlocks := (size + maxBlockSize - 1) / maxBlockSize
+	piece := &partialPiece{
+		buf:        make([]byte, size),
+		received:   make([]bool, numBlocks),
+		requesters: make([][]*peerConn, numBlocks),
+		senders:    make([]*peerConn, numBlocks),
+		left:       numBlocks,
+	}
+	p.partial[index] = piece
+	return piece
+}
+
+// endgame reports whether every block we are missing is requested.
+func (p *picker) endgame() bool {
+	for index, missing := range p.missing {
+		if !missing {
+			continue
+		}
+		piece := p.partial[index]
+		if piece == nil {
+			return false
+		}
+		for b := range piece.received {
+			if !piece.received[b] && len(piece.requesters[b]) == 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// pickEndgame assigns up to n missing blocks pc was not asked for yet, those
+// requested from the fewest peers first.
+func (p *picker) pickEndgame(pc *peerConn, bf bitfield.BitField, n int) []block {
+	type candidate struct {
+		index int
+		piece *partialPiece
+		b     int
+	}
+	var candidates []candidate
+	for index, piece := range p.partial {
+		if !bf.HasPiece(index) {
+			continue
+		}
+		for b := range piece.received {
+			if !piece.received[b] && !requestedFrom(piece.requesters[b], pc) {
+				candidates = append(candidates, candidate{index, piece, b})
+			}
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	var blocks []block
+	for fewest := 1; len(blocks) < n && len(candidates) > 0; fewest++ {
+		rest := candidates[:0]
+		for _, c := range candidates {
+			if len(blocks) < n && len(c.piece.requesters[c.b]) <= fewest {
+				blocks = append(blocks, p.request(pc, c.index, c.piece, c.b))
+			} else {
+				rest = append(rest, c)
+			}
+		}
+		candidates = rest
+	}
+	return blocks
+}
+
+func requestedFrom(requesters []*peerConn, pc *peerConn) bool {
+	for _, r := range requesters {
+		if r == pc {
+			return true
+		}
+	}
+	return false
+}
+
+func removeRequester(requesters []*peerConn, pc *peerConn) ([]*peerConn, bool) {
+	for i, r := range requesters {
+		if r == pc {
+			return append(requesters[:i], requesters[i+1:]...), true
+		}
+	}
+	return requesters, false
+}
+
+// received stores a block pc sent. It returns the other peers the block was
+// requested from, which should get a Cancel, and the piece's data once every
+// block is in. Blocks of pieces we are not downloading are ignored.
+func (p *picker) received(pc *peerConn, index, begin int, data []byte) (cancel []*peerConn, piece []byte, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	partial := p.partial[index]
+	if partial == nil {
+		return nil, nil, nil
+	}
+	b := begin / maxBlockSize
+	if begin%maxBlockSize != 0 || b >= len(partial.received) {
+		return nil, nil, fmt.Errorf("unexpected block at %d of piece #%d", begin, index)
+	}
+	length := maxBlockSize
+	if begin+length > len(partial.buf) {
+		length = len(partial.buf) - begin
+	}
+	if len(data) != length {
+		return nil, nil, fmt.Errorf("block at %d of piece #%d has length %d", begin, index, len(data))
+	}
+
+	var ok bool
+	partial.requesters[b], ok = removeRequester(partial.requesters[b], pc)
+	if ok {
+		p.requests[pc]--
+	}
+	if partial.received[b] {
+		return nil, nil, nil
+	}
+	copy(partial.buf[begin:], data)
+	partial.received[b] = true
+	partial.senders[b] = pc
+	partial.left--
+	for _, other := range partial.requesters[b] {
+		p.requests[other]--
+	}
+	cancel = partial.requesters[b]
+	partial.requesters[b] = nil
+	if partial.left == 0 {
+		piece = partial.buf
+	}
+	return cancel, piece, nil
+}
+
+// releasePeer gives up the blocks requested from pc, as when it chokes us or
+// disconnects, so other peers can request them. Blocks it already sent are
+// kept.
+func (p *picker) releasePeer(pc *peerConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, piece := range p.partial {
+		for b := range piece.requesters {
+			piece.requesters[b], _ = removeRequester(piece.requesters[b], pc)
+		}
+	}
+	delete(p.requests, pc)
+}
+
+// failed discards a piece that did not match its hash and returns the peer
+// each of its blocks came from.
+func (p *picker) failed(index int) []*peerConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	piece := p.partial[index]
+	if piece == nil {
+		return nil
+	}
+	delete(p.partial, index)
+	return piece.senders
+}
+
+// done marks a piece as downloaded and verified.
+func (p *picker) done(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.missing[index] {
+		return
+	}
+	p.missing[index] = false
+	delete(p.partial, index)
+	p.left--
+	p.have++
+}
+
+func (p *picker) finished() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.left == 0
+}
+
+// interesting reports whether a peer with bf has any piece we are missing.
+func (p *picker) interesting(bf bitfield.BitField) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for index, missing := range p.missing {
+		if missing && bf.HasPiece(index) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,251 @@
+package p2p
+
+import (
+	"bittorrent_client/bitfield"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func bitfieldOf(numPieces int, indices ...int) bitfield.BitField {
+	bf := make(bitfield.BitField, (numPieces+7)/8)
+	for _, index := range indices {
+		bf.SetPiece(index)
+	}
+	return bf
+}
+
+// newTestPicker returns a picker of numPieces pieces of two blocks each, the
+// last one a block and a half, with the pieces in have already downloaded.
+func newTestPicker(numPieces int, have ...int) *picker {
+	return newPicker(numPieces, bitfieldOf(numPieces, have...), func(index int) int {
+		if index == numPieces-1 {
+			return maxBlockSize + maxBlockSize/2
+		}
+		return 2 * maxBlockSize
+	})
+}
+
+func TestPickPieceRarestFirst(t *testing.T) {
+	p := newTestPicker(8, 0, 1, 2, 3)
+	p.addPeer(bitfieldOf(8, 4, 5, 6, 7))
+	p.addPeer(bitfieldOf(8, 4, 5, 6))
+	p.addPeer(bitfieldOf(8, 4, 5))
+
+	for i := 0; i < 20; i++ {
+		index, ok := p.pickPiece(bitfieldOf(8, 0, 1, 2, 3, 4, 5, 6, 7))
+		assert.True(t, ok)
+		assert.Equal(t, 7, index)
+	}
+	index, ok := p.pickPiece(bitfieldOf(8, 4, 5, 6))
+	assert.True(t, ok)
+	assert.Equal(t, 6, index)
+	_, ok = p.pickPiece(bitfieldOf(8, 0, 1))
+	assert.False(t, ok, "pieces we have are never picked")
+}
+
+func TestPickPieceBreaksTiesAtRandom(t *testing.T) {
+	p := newTestPicker(8, 0, 1, 2, 3)
+	p.addPeer(bitfieldOf(8, 4, 5, 6, 7))
+	p.addPeer(bitfieldOf(8, 4, 5))
+
+	picked := map[int]bool{}
+	for i := 0; i < 100; i++ {
+		index, _ := p.pickPiece(bitfieldOf(8, 4, 5, 6, 7))
+		picked[index] = true
+	}
+	assert.Equal(t, map[int]bool{6: true, 7: true}, picked)
+}
+
+func TestPickPieceRandomFirst(t *testing.T) {
+	p := newTestPicker(8)
+	p.addPeer(bitfieldOf(8, 0, 1, 2, 3, 4, 5, 6, 7))
+	p.addPeer(bitfieldOf(8, 0, 1, 2, 3, 4, 5, 6))
+
+	// piece 7 is the rarest, but before randomFirstPieces pieces are in
+	// every piece is as likely
+	picked := map[int]bool{}
+	for i := 0; i < 200; i++ {
+		index, _ := p.pickPiece(bitfieldOf(8, 0, 1, 2, 3, 4, 5, 6, 7))
+		picked[index] = true
+	}
+	assert.Len(t, picked, 8)
+}
+
+func TestAvailability(t *testing.T) {
+	p := newTestPicker(4)
+	a := bitfieldOf(4, 0, 1)
+	b := bitfieldOf(4, 1)
+	p.addPeer(a)
+	p.addPeer(b)
+	assert.Equal(t, []int{1, 2, 0, 0}, p.availability)
+
+	p.peerHas(3)
+	b.SetPiece(3)
+	p.peerHas(4) // out of range, ignored
+	assert.Equal(t, []int{1, 2, 0, 1}, p.availability)
+
+	p.removePeer(b)
+	assert.Equal(t, []int{1, 1, 0, 0}, p.availability)
+	p.removePeer(a)
+	assert.Equal(t, []int{0, 0, 0, 0}, p.availability)
+}
+
+func blockSet(blocks []block) map[block]bool {
+	set := map[block]bool{}
+	for _, b := range blocks {
+		set[b] = true
+	}
+	return set
+}
+
+func TestEndgameStartsOnceEveryBlockIsRequested(t *testing.T) {
+	p := newTestPicker(2)
+	all := bitfieldOf(2, 0, 1)
+	a, b := &peerConn{}, &peerConn{}
+
+	assert.Len(t, p.pickBlocks(a, all, 3), 3)
+	assert.False(t, p.endgame())
+	// the last unrequested block is handed out before any duplicates
+	assert.Len(t, p.pickBlocks(b, all, 10), 1)
+	assert.True(t, p.endgame())
+
+	duplicates := p.pickBlocks(b, all, 10)
+	assert.Len(t, duplicates, 3, "b gets the blocks only a was asked for")
+	assert.Empty(t, p.pickBlocks(b, all, 10), "blocks are not requested twice from one peer")
+	assert.Equal(t, 4, p.outstanding(b))
+}
+
+func TestEndgamePrefersLeastRequestedBlocks(t *testing.T) {
+	p := newTestPicker(2)
+	all := bitfieldOf(2, 0, 1)
+	a, b, c := &peerConn{}, &peerConn{}, &peerConn{}
+
+	requested := blockSet(p.pickBlocks(a, all, 4))
+	assert.Len(t, requested, 4)
+	fromB := blockSet(p.pickBlocks(b, all, 2))
+	assert.Len(t, fromB, 2)
+
+	// c first gets the two blocks requested from a alone
+	fromC := blockSet(p.pickBlocks(c, all, 2))
+	assert.Len(t, fromC, 2)
+	for blk := range fromC {
+		assert.False(t, fromB[blk])
+	}
+	// then the ones requested from both
+	assert.Equal(t, fromB, blockSet(p.pickBlocks(c, all, 2)))
+}
+
+func TestReceivedReturnsOtherRequestersToCancel(t *testing.T) {
+	p := newTestPicker(1)
+	all := bitfieldOf(1, 0)
+	a, b, c := &peerConn{}, &peerConn{}, &peerConn{}
+
+	p.pickBlocks(a, all, 2)
+	p.pickBlocks(b, all, 2)
+	blk := p.pickBlocks(c, all, 1)[0]
+
+	cancel, piece, err := p.received(c, 0, blk.begin, make([]byte, blk.length))
+	assert.Nil(t, err)
+	assert.Nil(t, piece)
+	if !assert.Len(t, cancel, 2) {
+		return
+	}
+	assert.ElementsMatch(t, []*peerConn{a, b}, cancel)
+	assert.Equal(t, 1, p.outstanding(a))
+	assert.Equal(t, 1, p.outstanding(b))
+	assert.Equal(t, 0, p.outstanding(c))
+
+	// a late duplicate is dropped and cancels nothing
+	cancel, piece, err = p.received(a, 0, blk.begin, make([]byte, blk.length))
+	assert.Nil(t, err)
+	assert.Nil(t, piece)
+	assert.Empty(t, cancel)
+}
+
+func TestReceivedChecksBlocks(t *testing.T) {
+	tests := map[string]struct {
+		index  int
+		begin  int
+		length int
+		fails  bool
+	}{
+		"first block":              {index: 0, begin: 0, length: maxBlockSize},
+		"short last block":         {index: 2, begin: maxBlockSize, length: maxBlockSize / 2},
+		"unaligned offset":         {index: 0, begin: 100, length: maxBlockSize, fails: true},
+		"offset past the piece":    {index: 0, begin: 2 * maxBlockSize, length: maxBlockSize, fails: true},
+		"short block":              {index: 0, begin: 0, length: 100, fails: true},
+		"last block too long":      {index: 2, begin: maxBlockSize, length: maxBlockSize, fails: true},
+		"piece not in progress":    {index: 1, begin: 0, length: maxBlockSize},
+		"block bigger than usual":  {index: 0, begin: 0, length: 2 * maxBlockSize, fails: true},
+		"offset inside last block": {index: 2, begin: maxBlockSize + 1, length: 1, fails: true},
+	}
+
+	for name, test := range tests {
+		p := newTestPicker(3)
+		pc := &peerConn{}
+		p.pickBlocks(pc, bitfieldOf(3, 0, 2), 4)
+
+		_, _, err := p.received(pc, test.index, test.begin, make([]byte, test.length))
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+	}
+}
+
+func TestSharedPieceSurvivesChoke(t *testing.T) {
+	p := newTestPicker(1)
+	all := bitfieldOf(1, 0)
+	a, b := &peerConn{}, &peerConn{}
+
+	first := p.pickBlocks(a, all, 1)
+	second := p.pickBlocks(b, all, 1)
+	assert.Equal(t, []block{{0, 0, maxBlockSize}}, first)
+	assert.Equal(t, []block{{0, maxBlockSize, maxBlockSize / 2}}, second, "b helps with a's piece")
+
+	_, piece, err := p.received(a, 0, 0, bytes.Repeat([]byte{1}, maxBlockSize))
+	assert.Nil(t, err)
+	assert.Nil(t, piece)
+
+	// b chokes us; its block goes back to the pool while a's stays received
+	p.releasePeer(b)
+	assert.Equal(t, 0, p.outstanding(b))
+	assert.Equal(t, second, p.pickBlocks(a, all, 5))
+
+	_, piece, err = p.received(a, 0, maxBlockSize, bytes.Repeat([]byte{2}, maxBlockSize/2))
+	assert.Nil(t, err)
+	expected := append(bytes.Repeat([]byte{1}, maxBlockSize), bytes.Repeat([]byte{2}, maxBlockSize/2)...)
+	assert.Equal(t, expected, piece)
+	assert.Equal(t, 0, p.outstanding(a))
+}
+
+func TestFailedPieceIsDownloadedAgain(t *testing.T) {
+	p := newTestPicker(1)
+	all := bitfieldOf(1, 0)
+	a, b := &peerConn{}, &peerConn{}
+
+	blocks := p.pickBlocks(a, all, 2)
+	p.received(a, 0, blocks[0].begin, make([]byte, blocks[0].length))
+	p.received(a, 0, blocks[1].begin, make([]byte, blocks[1].length))
+
+	senders := p.failed(0)
+	assert.Equal(t, []*peerConn{a, a}, senders)
+	assert.Equal(t, blocks, p.pickBlocks(b, all, 2))
+	assert.Nil(t, p.failed(1), "pieces not in progress have no senders")
+}
+
+func TestDone(t *testing.T) {
+	p := newTestPicker(2, 0)
+	assert.False(t, p.finished())
+	assert.True(t, p.interesting(bitfieldOf(2, 1)))
+
+	p.pickBlocks(&peerConn{}, bitfieldOf(2, 1), 2)
+	p.done(1)
+	p.done(1)
+	assert.True(t, p.finished())
+	assert.False(t, p.interesting(bitfieldOf(2, 0, 1)))
+	assert.Empty(t, p.partial)
+}
@@ -0,0 +1,110 @@
+package p2p
+
+import (
+	"bittorrent_client/peers"
+	"math"
+	"time"
+)
+
+const (
+	// initialPipeline is how many blocks are requested from a peer before its
+	// rate and round-trip time are known
+	initialPipeline = 5
+	minPipeline     = 2
+	// maxPipeline caps the pipeline of peers that do not advertise reqq
+	maxPipeline = 250
+	// rateWindow is how long each download rate sample spans
+	rateWindow = time.Second
+)
+
+// PeerStats describes a connection of the torrent.
+type PeerStats struct {
+	Peer peers.Peer
+	// DownloadRate is in bytes per second
+	DownloadRate float64
+	RTT          time.Duration
+	// Pipeline is how many blocks we keep requested from the peer
+	Pipeline       int
+	AmChoking      bool
+	PeerInterested bool
+}
+
+func (t *Torrent) PeerStats() []PeerStats {
+	conns := t.peerConns()
+	stats := make([]PeerStats, 0, len(conns))
+	for _, pc := range conns {
+		pc.statsMu.Lock()
+		stats = append(stats, PeerStats{
+			Peer:           pc.client.Peer(),
+			DownloadRate:   pc.rate,
+			RTT:            pc.minRTT,
+			Pipeline:       pc.pipeline,
+			AmChoking:      pc.client.AmChoking(),
+			PeerInterested: pc.client.PeerInterested(),
+		})
+		pc.statsMu.Unlock()
+	}
+	return stats
+}
+
+// recordBlock updates the download rate and round-trip time of the peer with
+// a block of n bytes that arrived latency after we requested it.
+func (pc *peerConn) recordBlock(n int, latency time.Duration, now time.Time) {
+	pc.statsMu.Lock()
+	defer pc.statsMu.Unlock()
+	// queueing behind earlier requests only adds to the latency, so the
+	// fastest block is the best estimate of the round trip
+	if pc.minRTT == 0 || latency < pc.minRTT {
+		pc.minRTT = latency
+	}
+	if pc.windowStart.IsZero() {
+		pc.windowStart = now
+	}
+	pc.window += n
+	elapsed := now.Sub(pc.windowStart)
+	if elapsed < rateWindow {
+		return
+	}
+	sample := float64(pc.window) / elapsed.Seconds()
+	if pc.rate == 0 {
+		pc.rate = sample
+	} else {
+		pc.rate = (pc.rate + sample) / 2
+	}
+	pc.window = 0
+	pc.windowStart = now
+}
+
+// pipelineDepth is how many blocks to keep requested from the peer, within
+// the queue length it advertised.
+func (pc *peerConn) pipelineDepth() int {
+	reqq := 0
+	if pc.client.Extended != nil {
+		reqq = pc.client.Extended.ReqQ
+	}
+	pc.statsMu.Lock()
+	defer pc.statsMu.Unlock()
+	pc.pipeline = pipelineDepth(pc.rate, pc.minRTT, reqq)
+	return pc.pipeline
+}
+
+// pipelineDepth covers twice the bandwidth-delay product of a peer sending
+// rate bytes per second with round-trip time rtt. The slack lets the rate,
+// and with it the depth, keep growing until the link is saturated.
+func pipelineDepth(rate float64, rtt time.Duration, reqq int) int {
+	depth := initialPipeline
+	if rate > 0 && rtt > 0 {
+		depth = int(math.Ceil(2 * rate * rtt.Seconds() / maxBlockSize))
+	}
+	limit := maxPipeline
+	if reqq > 0 && reqq < limit {
+		limit = reqq
+	}
+	if depth > limit {
+		depth = limit
+	}
+	if depth < minPipeline {
+		depth = minPipeline
+	}
+	return depth
+}
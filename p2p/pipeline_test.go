@@ -0,0 +1,58 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineDepth(t *testing.T) {
+	tests := map[string]struct {
+		rate   float64
+		rtt    time.Duration
+		reqq   int
+		output int
+	}{
+		"nothing measured yet":      {output: initialPipeline},
+		"initial depth within reqq": {reqq: 3, output: 3},
+		"twice the bandwidth-delay product": {
+			rate: 1 << 20, rtt: 100 * time.Millisecond, output: 13,
+		},
+		"capped by reqq": {
+			rate: 10 << 20, rtt: time.Second, reqq: 100, output: 100,
+		},
+		"capped by maxPipeline": {
+			rate: 10 << 20, rtt: time.Second, output: maxPipeline,
+		},
+		"reqq above maxPipeline": {
+			rate: 10 << 20, rtt: time.Second, reqq: 500, output: maxPipeline,
+		},
+		"slow peers keep minPipeline": {
+			rate: 1000, rtt: 10 * time.Millisecond, output: minPipeline,
+		},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.output, pipelineDepth(test.rate, test.rtt, test.reqq), name)
+	}
+}
+
+func TestRecordBlock(t *testing.T) {
+	pc := &peerConn{}
+	start := time.Now()
+
+	pc.recordBlock(maxBlockSize, 50*time.Millisecond, start)
+	pc.recordBlock(maxBlockSize, 80*time.Millisecond, start.Add(500*time.Millisecond))
+	assert.Equal(t, 50*time.Millisecond, pc.minRTT, "the fastest block sets the round trip")
+	assert.Equal(t, 0.0, pc.rate, "no rate before a window passed")
+
+	pc.recordBlock(maxBlockSize, 30*time.Millisecond, start.Add(time.Second))
+	assert.Equal(t, 30*time.Millisecond, pc.minRTT)
+	assert.Equal(t, float64(3*maxBlockSize), pc.rate)
+
+	// later windows are averaged in
+	pc.recordBlock(maxBlockSize, 40*time.Millisecond, start.Add(2*time.Second))
+	assert.Equal(t, float64(2*maxBlockSize), pc.rate)
+	assert.Equal(t, 30*time.Millisecond, pc.minRTT)
+}
@@ -0,0 +1,165 @@
+package p2p
+
+import (
+	"bittorrent_client/bitfield"
+	"bittorrent_client/client"
+	"bittorrent_client/peers"
+	"bittorrent_client/pex"
+	"log"
+	"time"
+)
+
+// idleTimeout drops connections we are not waiting for blocks on when the
+// peer sends nothing, not even keep-alives.
+const idleTimeout = 3 * time.Minute
+
+// seedCheckInterval is how often Seed compares the upload with SeedRatio.
+const seedCheckInterval = 10 * time.Second
+
+func (t *Torrent) hasPiece(index int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return index >= 0 && index < len(t.PieceHashes) && t.Completed.HasPiece(index)
+}
+
+// isComplete reports whether bf has every piece of the torrent.
+func (t *Torrent) isComplete(bf bitfield.BitField) bool {
+	for index := range t.PieceHashes {
+		if !bf.HasPiece(index) {
+			return false
+		}
+	}
+	return true
+}
+
+// addPeerConn registers a connection for Have broadcasts and choking. It
+// returns false once the torrent stopped, in which case the connection should
+// be dropped.
+func (t *Torrent) addPeerConn(pc *peerConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return false
+	}
+	if t.clients == nil {
+		t.clients = map[*client.Client]*peerConn{}
+	}
+	t.clients[pc.client] = pc
+	return true
+}
+
+func (t *Torrent) removePeerConn(pc *peerConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.clients, pc.client)
+	if t.optimistic == pc {
+		t.optimistic = nil
+	}
+}
+
+// broadcastHave tells every connected peer that we got a piece.
+func (t *Torrent) broadcastHave(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for c := range t.clients {
+		go c.SendHave(index)
+	}
+}
+
+// Close stops the choker, drops every peer, waits for their workers to exit
+// and saves the resume data. Seed closes the torrent when it finishes; after
+// Download failed, Close has to be called instead.
+func (t *Torrent) Close() {
+	t.stopChoker()
+	t.markDone()
+	t.mu.Lock()
+	t.stopped = true
+	for c := range t.clients {
+		c.Conn.Close()
+	}
+	t.mu.Unlock()
+	t.workers.Wait()
+	t.saveResume()
+}
+
+// seedPeer answers the peer's requests once there is nothing left to download
+// from it, until the connection fails or goes idle, or the peer completes too.
+func (t *Torrent) seedPeer(pc *peerConn, pexSender *pex.Sender) {
+	c := pc.client
+	for !t.isComplete(c.Bitfield) {
+		t.sendPex(c, pexSender, c.Peer())
+		c.Conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		err := pc.readMessage()
+		if err != nil {
+			t.banIfViolation(pc, err)
+			return
+		}
+	}
+}
+
+// seedLimitReached reports whether we uploaded SeedRatio times the torrent's
+// length.
+func (t *Torrent) seedLimitReached() bool {
+	return t.SeedRatio > 0 && float64(t.uploaded.Load()) >= t.SeedRatio*float64(t.Length)
+}
+
+// Seed keeps uploading after Download completed, until we uploaded SeedRatio
+// times the torrent's length, SeedTime passed or Stop was closed. A zero limit
+// does not apply; with both zero Seed only closes the connections.
+func (t *Torrent) Seed() {
+	defer t.Close()
+	if t.SeedRatio <= 0 && t.SeedTime <= 0 {
+		return
+	}
+	log.Println("Seeding", t.Name)
+	t.startChoker()
+
+	var deadline <-chan time.Time
+	if t.SeedTime > 0 {
+		timer := time.NewTimer(t.SeedTime)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(seedCheckInterval)
+	defer ticker.Stop()
+
+	// workers find nothing left to download and go straight to seeding
+	if t.picker == nil {
+		t.picker = newPicker(len(t.PieceHashes), t.Completed, t.calculatePieceSize)
+	}
+	if t.discovered == nil {
+		t.discovered = make(chan []peers.Peer, 16)
+		t.slotFreed = make(chan struct{}, 1)
+	}
+	if t.Bans == nil {
+		t.Bans = NewBanList()
+	}
+	t.addCandidates(t.Peers)
+	t.dialCandidates(nil)
+
+	for !t.seedLimitReached() {
+		select {
+		case ps := <-t.LocalPeers:
+			t.addCandidates(ps)
+			t.dialCandidates(nil)
+		case ps := <-t.NewPeers:
+			t.addCandidates(ps)
+			t.dialCandidates(nil)
+		case ps := <-t.discovered:
+			t.addCandidates(ps)
+			t.dialCandidates(nil)
+		case c := <-t.Incoming:
+			t.acceptPeer(c, nil)
+		case <-t.slotFreed:
+			t.dialCandidates(nil)
+		case <-ticker.C:
+			t.dialCandidates(nil)
+		case <-deadline:
+			log.Println("Seed time reached for", t.Name)
+			return
+		case <-t.Stop:
+			return
+		}
+	}
+	log.Println("Seed ratio reached for", t.Name)
+}
@@ -0,0 +1,164 @@
+package p2p
+
+import (
+	"bittorrent_client/message"
+	"bittorrent_client/peers"
+	"bittorrent_client/storage"
+	"crypto/sha1"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSeedTorrent returns a complete torrent of two pieces of 100 bytes.
+func newSeedTorrent() *Torrent {
+	return &Torrent{
+		PieceHashes: make([][20]byte, 2),
+		PieceLength: 100,
+		Length:      200,
+		Completed:   bitfieldOf(2, 0, 1),
+		NewPeers:    make(chan []peers.Peer),
+		Bans:        NewBanList(),
+	}
+}
+
+func TestSeedPeerStopsOnceThePeerCompletes(t *testing.T) {
+	tr := newSeedTorrent()
+	tr.picker = newPicker(2, tr.Completed, tr.calculatePieceSize)
+	pc := newTestPeerConn(t, tr, "10.0.0.1", bitfieldOf(2, 0), false)
+	peerSends(t, pc, message.FormatHave(1))
+
+	done := make(chan struct{})
+	go func() {
+		tr.seedPeer(pc, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("seedPeer kept serving a complete peer")
+	}
+	assert.False(t, tr.Bans.Banned(pc.client.Peer().IP))
+}
+
+func TestSeedPeerBansProtocolViolations(t *testing.T) {
+	tr := newSeedTorrent()
+	tr.picker = newPicker(2, tr.Completed, tr.calculatePieceSize)
+	pc := newTestPeerConn(t, tr, "10.0.0.1", nil, false)
+	peerSends(t, pc, message.FormatHave(9))
+
+	tr.seedPeer(pc, nil)
+	assert.True(t, tr.Bans.Banned(pc.client.Peer().IP))
+}
+
+func TestSeedStopsWithoutLimits(t *testing.T) {
+	tr := newSeedTorrent()
+	tr.Seed()
+	assert.True(t, tr.stopped)
+}
+
+func TestSeedStopsAtRatio(t *testing.T) {
+	tr := newSeedTorrent()
+	tr.SeedRatio = 1.5
+
+	done := make(chan struct{})
+	go func() {
+		tr.Seed()
+		close(done)
+	}()
+	tr.uploaded.Store(200)
+	tr.NewPeers <- nil
+	select {
+	case <-done:
+		t.Fatal("Seed stopped below the ratio")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tr.uploaded.Store(300)
+	tr.NewPeers <- nil
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Seed kept going past the ratio")
+	}
+}
+
+func TestSeedStopsAtSeedTime(t *testing.T) {
+	tr := newSeedTorrent()
+	tr.SeedRatio = 1
+	tr.SeedTime = 50 * time.Millisecond
+
+	start := time.Now()
+	tr.Seed()
+	assert.GreaterOrEqual(t, time.Since(start), tr.SeedTime)
+	assert.Less(t, tr.uploaded.Load(), int64(tr.Length))
+}
+
+func TestSeedStopsOnStop(t *testing.T) {
+	tr := newSeedTorrent()
+	tr.SeedRatio = 1
+	tr.Stop = make(chan struct{})
+	close(tr.Stop)
+
+	tr.Seed()
+	assert.True(t, tr.stopped)
+}
+
+func TestDownloadStopsOnStop(t *testing.T) {
+	tr := newSeedTorrent()
+	tr.Completed = bitfieldOf(2, 0)
+	tr.Stop = make(chan struct{})
+	close(tr.Stop)
+
+	assert.ErrorIs(t, tr.Download(), ErrStopped)
+	tr.Close()
+	assert.False(t, tr.isComplete(tr.Completed))
+}
+
+func TestCloseSavesResume(t *testing.T) {
+	dir := t.TempDir()
+	st, err := storage.New([]storage.File{{Path: filepath.Join(dir, "data"), Length: 200}})
+	require.Nil(t, err)
+	defer st.Close()
+	tr := newSeedTorrent()
+	tr.Completed = bitfieldOf(2, 1)
+	tr.Storage = st
+	tr.ResumePath = filepath.Join(dir, "data.resume")
+
+	tr.Close()
+	completed, stale, err := st.LoadResume(tr.ResumePath, 2)
+	assert.Nil(t, err)
+	assert.False(t, stale)
+	assert.Equal(t, tr.Completed, completed)
+}
+
+func TestCloseDoesNotWaitForDownload(t *testing.T) {
+	piece := make([]byte, maxBlockSize)
+	tr := &Torrent{
+		PieceHashes: [][20]byte{sha1.Sum(piece)},
+		PieceLength: maxBlockSize,
+		Length:      maxBlockSize,
+		Completed:   bitfieldOf(1),
+	}
+	tr.picker = newPicker(1, tr.Completed, tr.calculatePieceSize)
+	pc := newTestPeerConn(t, tr, "10.0.0.1", bitfieldOf(1, 0), false)
+	// nobody receives the piece, as when Download returned early
+	pc.results = make(chan *resultsContainer)
+	pc.requestedAt = map[block]time.Time{}
+	tr.picker.pickBlocks(pc, pc.client.Bitfield, 1)
+
+	done := make(chan error)
+	go func() {
+		done <- pc.receiveBlock(message.FormatPiece(0, 0, piece))
+	}()
+	tr.Close()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("receiveBlock still blocked after Close")
+	}
+}
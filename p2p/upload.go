@@ -0,0 +1,142 @@
+package p2p
+
+import (
+	"bittorrent_client/client"
+	"bittorrent_client/message"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// request is a block a peer asked us for.
+type request struct {
+	index  int
+	begin  int
+	length int
+}
+
+// uploader sends the blocks a peer requested from its own goroutine, so
+// writing to a peer that reads slowly does not stop us reading from it.
+type uploader struct {
+	torrent *Torrent
+	peer    *peerConn
+
+	mu    sync.Mutex
+	queue []request
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+func newUploader(t *Torrent, pc *peerConn) *uploader {
+	u := &uploader{
+		torrent: t,
+		peer:    pc,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go u.run()
+	return u
+}
+
+func (u *uploader) close() {
+	close(u.done)
+}
+
+// request queues the block a request message asks for. Requests while we
+// choke the peer or beyond client.RequestQueueLength are dropped, requests for
+// pieces we do not have or outside a piece are an error.
+func (u *uploader) request(msg *message.Message) error {
+	index, begin, length, err := message.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	if !u.torrent.hasPiece(index) {
+		return fmt.Errorf("peer requested piece #%d which we do not have", index)
+	}
+	if length <= 0 || length > maxBlockSize || begin < 0 || begin+length > u.torrent.calculatePieceSize(index) {
+		return fmt.Errorf("invalid request for piece #%d: begin %d, length %d", index, begin, length)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.peer.client.AmChoking() || len(u.queue) >= client.RequestQueueLength {
+		return nil
+	}
+	u.queue = append(u.queue, request{index, begin, length})
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// cancel removes a queued request. Blocks that were already sent cannot be
+// taken back.
+func (u *uploader) cancel(msg *message.Message) error {
+	index, begin, length, err := message.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i, req := range u.queue {
+		if req == (request{index, begin, length}) {
+			u.queue = append(u.queue[:i], u.queue[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// clear drops every queued request, as choking the peer does.
+func (u *uploader) clear() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.queue = nil
+}
+
+func (u *uploader) next() (request, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.queue) == 0 {
+		return request{}, false
+	}
+	req := u.queue[0]
+	u.queue = u.queue[1:]
+	return req, true
+}
+
+func (u *uploader) run() {
+	for {
+		select {
+		case <-u.wake:
+		case <-u.done:
+			return
+		}
+		for req, ok := u.next(); ok; req, ok = u.next() {
+			block := make([]byte, req.length)
+			_, err := u.torrent.Storage.ReadAt(block, int64(req.index*u.torrent.PieceLength+req.begin))
+			if err != nil {
+				log.Printf("Could not read piece #%d: %v\n", req.index, err)
+				// the peer's requests would only pile up, so drop it and
+				// let its worker clean up
+				u.peer.client.Conn.Close()
+				return
+			}
+			err = u.peer.client.SendPiece(req.index, req.begin, block)
+			if err != nil {
+				u.peer.client.Conn.Close()
+				return
+			}
+			u.peer.uploaded.Add(int64(req.length))
+			u.torrent.uploaded.Add(int64(req.length))
+
+			select {
+			case <-u.done:
+				return
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package p2p
+
+import (
+	"bittorrent_client/client"
+	"bittorrent_client/message"
+	"bittorrent_client/storage"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newUploadTorrent returns a torrent of a piece of two blocks and a piece of
+// one block, of which we have the first.
+func newUploadTorrent() *Torrent {
+	return &Torrent{
+		PieceHashes: make([][20]byte, 2),
+		PieceLength: 2 * maxBlockSize,
+		Length:      3 * maxBlockSize,
+		Completed:   bitfieldOf(2, 0),
+		Bans:        NewBanList(),
+	}
+}
+
+// newTestUploader returns an uploader for pc that queues requests but does
+// not send them.
+func newTestUploader(tr *Torrent, pc *peerConn) *uploader {
+	u := &uploader{torrent: tr, peer: pc, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	pc.uploads = u
+	return u
+}
+
+func TestUploaderRequest(t *testing.T) {
+	tests := map[string]struct {
+		index  int
+		begin  int
+		length int
+		fails  bool
+	}{
+		"first block":              {index: 0, begin: 0, length: maxBlockSize, fails: false},
+		"short block at the end":   {index: 0, begin: maxBlockSize + 1, length: maxBlockSize - 1, fails: false},
+		"piece we do not have":     {index: 1, begin: 0, length: maxBlockSize, fails: true},
+		"piece out of range":       {index: 2, begin: 0, length: maxBlockSize, fails: true},
+		"empty block":              {index: 0, begin: 0, length: 0, fails: true},
+		"block longer than 16 KiB": {index: 0, begin: 0, length: maxBlockSize + 1, fails: true},
+		"block past the piece end": {index: 0, begin: maxBlockSize + 1, length: maxBlockSize, fails: true},
+	}
+
+	for name, test := range tests {
+		tr := newUploadTorrent()
+		pc := newTestPeerConn(t, tr, "10.0.0.1", nil, false)
+		u := newTestUploader(tr, pc)
+		pc.client.SendUnchoke()
+
+		err := u.request(message.FormatRequest(test.index, test.begin, test.length))
+		if test.fails {
+			assert.NotNil(t, err, name)
+			assert.Empty(t, u.queue, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, []request{{test.index, test.begin, test.length}}, u.queue, name)
+		}
+	}
+}
+
+func TestInvalidRequestBansPeer(t *testing.T) {
+	tr := newUploadTorrent()
+	pc := newTestPeerConn(t, tr, "10.0.0.1", nil, false)
+	newTestUploader(tr, pc)
+	peerSends(t, pc, message.FormatRequest(1, 0, maxBlockSize))
+
+	err := pc.readMessage()
+	var violation *protocolError
+	assert.ErrorAs(t, err, &violation)
+	tr.banIfViolation(pc, err)
+	assert.True(t, tr.Bans.Banned(pc.client.Peer().IP))
+}
+
+func TestUploaderQueueLimit(t *testing.T) {
+	tr := newUploadTorrent()
+	pc := newTestPeerConn(t, tr, "10.0.0.1", nil, false)
+	u := newTestUploader(tr, pc)
+	pc.client.SendUnchoke()
+
+	for i := 0; i < client.RequestQueueLength+10; i++ {
+		assert.Nil(t, u.request(message.FormatRequest(0, 0, maxBlockSize)))
+	}
+	assert.Len(t, u.queue, client.RequestQueueLength, "requests beyond the queue are dropped")
+}
+
+func TestUploaderDropsRequestsWhileChoking(t *testing.T) {
+	tr := newUploadTorrent()
+	pc := newTestPeerConn(t, tr, "10.0.0.1", nil, false)
+	u := newTestUploader(tr, pc)
+
+	assert.Nil(t, u.request(message.FormatRequest(0, 0, maxBlockSize)))
+	assert.Empty(t, u.queue)
+
+	pc.client.SendUnchoke()
+	assert.Nil(t, u.request(message.FormatRequest(0, 0, maxBlockSize)))
+	assert.Len(t, u.queue, 1)
+	u.clear()
+	assert.Empty(t, u.queue)
+}
+
+func TestUploaderCancel(t *testing.T) {
+	tr := newUploadTorrent()
+	pc := newTestPeerConn(t, tr, "10.0.0.1", nil, false)
+	u := newTestUploader(tr, pc)
+	pc.client.SendUnchoke()
+
+	u.request(message.FormatRequest(0, 0, maxBlockSize))
+	u.request(message.FormatRequest(0, maxBlockSize, maxBlockSize))
+	u.request(message.FormatRequest(0, 100, 200))
+
+	assert.Nil(t, u.cancel(message.FormatCancel(0, maxBlockSize, maxBlockSize)))
+	assert.Equal(t, []request{{0, 0, maxBlockSize}, {0, 100, 200}}, u.queue)
+	assert.Nil(t, u.cancel(message.FormatCancel(0, 100, 300)), "cancelling a block never requested is harmless")
+	assert.Len(t, u.queue, 2)
+}
+
+func TestUploaderSendsQueuedBlocks(t *testing.T) {
+	tr := newUploadTorrent()
+	path := filepath.Join(t.TempDir(), "data")
+	st, err := storage.New([]storage.File{{Path: path, Length: tr.Length}})
+	require.Nil(t, err)
+	defer st.Close()
+	tr.Storage = st
+	pc := newTestPeerConn(t, tr, "10.0.0.1", nil, false)
+	pc.uploads = newUploader(tr, pc)
+	defer pc.uploads.close()
+	pc.client.SendUnchoke()
+
+	pc.uploads.request(message.FormatRequest(0, 0, maxBlockSize))
+	pc.uploads.request(message.FormatRequest(0, maxBlockSize, maxBlockSize))
+	assert.Eventually(t, func() bool { return tr.uploaded.Load() == 2*maxBlockSize }, time.Second, time.Millisecond)
+	assert.Equal(t, int64(2*maxBlockSize), pc.uploaded.Load())
+
+	// a block we cannot read drops the peer
+	require.Nil(t, os.Truncate(path, 0))
+	pc.uploads.request(message.FormatRequest(0, 0, maxBlockSize))
+	assert.Eventually(t, func() bool { return pc.client.SendHave(0) != nil }, time.Second, time.Millisecond)
+}
@@ -12,10 +12,19 @@ type Peer struct {
 	Port uint16
 }
 
+// GetPeers decodes the compact IPv4 peer list, 6 bytes per peer.
 func GetPeers(peersEncoded []byte) ([]Peer, error) {
-	const peerIPLen = 4
+	return getCompactPeers(peersEncoded, net.IPv4len)
+}
+
+// GetPeers6 decodes the compact IPv6 peer list (BEP 7), 18 bytes per peer.
+func GetPeers6(peersEncoded []byte) ([]Peer, error) {
+	return getCompactPeers(peersEncoded, net.IPv6len)
+}
+
+func getCompactPeers(peersEncoded []byte, peerIPLen int) ([]Peer, error) {
 	const peerPortLen = 2
-	const peerLen = peerIPLen + peerPortLen
+	peerLen := peerIPLen + peerPortLen
 	if len(peersEncoded)%peerLen != 0 {
 		err := fmt.Errorf("received malformed peers")
 		return nil, err
@@ -24,12 +33,41 @@ func GetPeers(peersEncoded []byte) ([]Peer, error) {
 	peers := make([]Peer, peersNumber)
 	for i := range peersNumber {
 		offset := i * peerLen
-		peers[i].IP = net.IP(peersEncoded[offset : offset+4])
-		peers[i].Port = binary.BigEndian.Uint16(peersEncoded[offset+4 : offset+6])
+		peers[i].IP = net.IP(peersEncoded[offset : offset+peerIPLen])
+		peers[i].Port = binary.BigEndian.Uint16(peersEncoded[offset+peerIPLen : offset+peerLen])
 	}
 	return peers, nil
 }
 
+// EncodePeers is the inverse of GetPeers. Peers that are not IPv4 are skipped.
+func EncodePeers(ps []Peer) []byte {
+	return encodeCompactPeers(ps, net.IPv4len)
+}
+
+// EncodePeers6 is the inverse of GetPeers6. IPv4 peers are skipped.
+func EncodePeers6(ps []Peer) []byte {
+	return encodeCompactPeers(ps, net.IPv6len)
+}
+
+func encodeCompactPeers(ps []Peer, peerIPLen int) []byte {
+	buf := make([]byte, 0, len(ps)*(peerIPLen+2))
+	for _, peer := range ps {
+		ip := peer.IP.To4()
+		if peerIPLen == net.IPv6len {
+			if ip != nil {
+				continue
+			}
+			ip = peer.IP.To16()
+		}
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, peer.Port)
+	}
+	return buf
+}
+
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
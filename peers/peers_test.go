@@ -38,6 +38,40 @@ func TestGetPeers(t *testing.T) {
 	}
 }
 
+func TestGetPeers6(t *testing.T) {
+	tests := map[string]struct {
+		input  []byte
+		output []Peer
+		fails  bool
+	}{
+		"correctly parses peers": {
+			input: []byte{
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1A, 0xE1,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x00, 0x50,
+			},
+			output: []Peer{
+				{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+				{IP: net.IPv6loopback, Port: 80},
+			},
+		},
+		"ipv4 sized entries": {
+			input:  []byte{127, 0, 0, 1, 0x00, 0x50},
+			output: nil,
+			fails:  true,
+		},
+	}
+
+	for _, test := range tests {
+		peers, err := GetPeers6(test.input)
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.output, peers)
+	}
+}
+
 func TestString(t *testing.T) {
 	tests := []struct {
 		input  Peer
@@ -47,9 +81,28 @@ func TestString(t *testing.T) {
 			input:  Peer{IP: net.IP{127, 0, 0, 1}, Port: 8080},
 			output: "127.0.0.1:8080",
 		},
+		{
+			input:  Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+			output: "[2001:db8::1]:6881",
+		},
 	}
 	for _, test := range tests {
 		s := test.input.String()
 		assert.Equal(t, test.output, s)
 	}
 }
+
+func TestEncodePeers(t *testing.T) {
+	ps := []Peer{
+		{IP: net.IP{127, 0, 0, 1}, Port: 80},
+		{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+		{IP: net.ParseIP("1.1.1.1"), Port: 443},
+	}
+	assert.Equal(t, []byte{127, 0, 0, 1, 0x00, 0x50, 1, 1, 1, 1, 0x01, 0xbb}, EncodePeers(ps))
+	assert.Equal(t, []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1A, 0xE1}, EncodePeers6(ps))
+	assert.Empty(t, EncodePeers(nil))
+
+	decoded, err := GetPeers(EncodePeers(ps))
+	assert.Nil(t, err)
+	assert.Equal(t, []Peer{ps[0], {IP: net.IP{1, 1, 1, 1}, Port: 443}}, decoded)
+}
@@ -0,0 +1,167 @@
+package pex
+
+import (
+	"bittorrent_client/peers"
+	"bytes"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// ExtensionName is the name ut_pex is negotiated under in the extended
+// handshake.
+const ExtensionName = "ut_pex"
+
+// BEP 11 asks for at most one message a minute, carrying no more than 50
+// added and 50 dropped peers.
+const (
+	Interval = time.Minute
+	MaxPeers = 50
+)
+
+// Flags describing an added peer, one byte per peer in added.f.
+const (
+	FlagEncryption = 0x01
+	FlagSeed       = 0x02
+	FlagUTP        = 0x04
+	FlagHolepunch  = 0x08
+	FlagReachable  = 0x10
+)
+
+type Message struct {
+	Added []peers.Peer
+	// AddedFlags holds the flags of Added, index by index
+	AddedFlags []byte
+	Dropped    []peers.Peer
+}
+
+type bencodeMessage struct {
+	Added    string `bencode:"added,omitempty"`
+	AddedF   string `bencode:"added.f,omitempty"`
+	Added6   string `bencode:"added6,omitempty"`
+	Added6F  string `bencode:"added6.f,omitempty"`
+	Dropped  string `bencode:"dropped,omitempty"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+func Parse(payload []byte) (Message, error) {
+	bm := bencodeMessage{}
+	err := bencode.Unmarshal(bytes.NewReader(payload), &bm)
+	if err != nil {
+		return Message{}, err
+	}
+
+	var m Message
+	added, err := peers.GetPeers([]byte(bm.Added))
+	if err != nil {
+		return Message{}, err
+	}
+	added6, err := peers.GetPeers6([]byte(bm.Added6))
+	if err != nil {
+		return Message{}, err
+	}
+	m.Added = append(added, added6...)
+	m.AddedFlags = append(flags(bm.AddedF, len(added)), flags(bm.Added6F, len(added6))...)
+
+	dropped, err := peers.GetPeers([]byte(bm.Dropped))
+	if err != nil {
+		return Message{}, err
+	}
+	dropped6, err := peers.GetPeers6([]byte(bm.Dropped6))
+	if err != nil {
+		return Message{}, err
+	}
+	m.Dropped = append(dropped, dropped6...)
+
+	if len(m.Added) == 0 {
+		m.Added, m.AddedFlags = nil, nil
+	}
+	if len(m.Dropped) == 0 {
+		m.Dropped = nil
+	}
+	return m, nil
+}
+
+// flags pads or truncates encoded to n entries, since some clients leave
+// added.f out.
+func flags(encoded string, n int) []byte {
+	f := make([]byte, n)
+	copy(f, encoded)
+	return f
+}
+
+func (m Message) Serialize() ([]byte, error) {
+	var added, added6 []peers.Peer
+	var addedF, added6F []byte
+	for i, peer := range m.Added {
+		var f byte
+		if i < len(m.AddedFlags) {
+			f = m.AddedFlags[i]
+		}
+		if peer.IP.To4() != nil {
+			added = append(added, peer)
+			addedF = append(addedF, f)
+		} else {
+			added6 = append(added6, peer)
+			added6F = append(added6F, f)
+		}
+	}
+	bm := bencodeMessage{
+		Added:    string(peers.EncodePeers(added)),
+		AddedF:   string(addedF),
+		Added6:   string(peers.EncodePeers6(added6)),
+		Added6F:  string(added6F),
+		Dropped:  string(peers.EncodePeers(m.Dropped)),
+		Dropped6: string(peers.EncodePeers6(m.Dropped)),
+	}
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, bm)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Sender remembers what was already announced to one peer, so every message
+// carries only the changes and goes out no more than once per Interval.
+type Sender struct {
+	sent map[string]peers.Peer
+	last time.Time
+}
+
+// Next returns the message that brings the peer up to date with connected,
+// or false if it is too early or nothing changed.
+func (s *Sender) Next(connected []peers.Peer, now time.Time) (Message, bool) {
+	if !s.last.IsZero() && now.Sub(s.last) < Interval {
+		return Message{}, false
+	}
+	if s.sent == nil {
+		s.sent = map[string]peers.Peer{}
+	}
+
+	current := make(map[string]bool, len(connected))
+	var m Message
+	for _, peer := range connected {
+		key := peer.String()
+		current[key] = true
+		if _, ok := s.sent[key]; ok || len(m.Added) == MaxPeers {
+			continue
+		}
+		s.sent[key] = peer
+		m.Added = append(m.Added, peer)
+		// we only share peers we managed to connect to
+		m.AddedFlags = append(m.AddedFlags, FlagReachable)
+	}
+	for key, peer := range s.sent {
+		if current[key] || len(m.Dropped) == MaxPeers {
+			continue
+		}
+		delete(s.sent, key)
+		m.Dropped = append(m.Dropped, peer)
+	}
+	if len(m.Added) == 0 && len(m.Dropped) == 0 {
+		return Message{}, false
+	}
+	s.last = now
+	return m, true
+}
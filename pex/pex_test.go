@@ -0,0 +1,134 @@
+package pex
+
+import (
+	"bittorrent_client/peers"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output Message
+		fails  bool
+	}{
+		"ipv4 and ipv6 peers": {
+			input: "d5:added12:" + string([]byte{127, 0, 0, 1, 0x1A, 0xE1, 1, 1, 1, 1, 0x01, 0xbb}) +
+				"7:added.f2:" + string([]byte{FlagReachable, FlagSeed}) +
+				"6:added618:" + string([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1A, 0xE1}) +
+				"8:added6.f1:" + string([]byte{FlagUTP}) +
+				"7:dropped6:" + string([]byte{10, 0, 0, 1, 0x00, 0x50}) + "e",
+			output: Message{
+				Added: []peers.Peer{
+					{IP: net.IP{127, 0, 0, 1}, Port: 6881},
+					{IP: net.IP{1, 1, 1, 1}, Port: 443},
+					{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+				},
+				AddedFlags: []byte{FlagReachable, FlagSeed, FlagUTP},
+				Dropped:    []peers.Peer{{IP: net.IP{10, 0, 0, 1}, Port: 80}},
+			},
+		},
+		"missing flags": {
+			input: "d5:added6:" + string([]byte{127, 0, 0, 1, 0x1A, 0xE1}) + "e",
+			output: Message{
+				Added:      []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}},
+				AddedFlags: []byte{0},
+			},
+		},
+		"empty": {
+			input:  "de",
+			output: Message{},
+		},
+		"malformed peers": {
+			input:  "d5:added5:abcdee",
+			output: Message{},
+			fails:  true,
+		},
+		"not bencoded": {
+			input:  "garbage",
+			output: Message{},
+			fails:  true,
+		},
+	}
+
+	for name, test := range tests {
+		m, err := Parse([]byte(test.input))
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, m, name)
+	}
+}
+
+func TestSerialize(t *testing.T) {
+	m := Message{
+		Added: []peers.Peer{
+			{IP: net.IP{127, 0, 0, 1}, Port: 6881},
+			{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+		},
+		AddedFlags: []byte{FlagReachable, FlagSeed},
+		Dropped:    []peers.Peer{{IP: net.IP{10, 0, 0, 1}, Port: 80}},
+	}
+	buf, err := m.Serialize()
+	assert.Nil(t, err)
+	assert.Equal(t, "d5:added6:"+string([]byte{127, 0, 0, 1, 0x1A, 0xE1})+
+		"7:added.f1:"+string([]byte{FlagReachable})+
+		"6:added618:"+string([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1A, 0xE1})+
+		"8:added6.f1:"+string([]byte{FlagSeed})+
+		"7:dropped6:"+string([]byte{10, 0, 0, 1, 0x00, 0x50})+"e", string(buf))
+
+	parsed, err := Parse(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, m, parsed)
+}
+
+func TestSender(t *testing.T) {
+	a := peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 1}
+	b := peers.Peer{IP: net.IP{10, 0, 0, 2}, Port: 2}
+	c := peers.Peer{IP: net.IP{10, 0, 0, 3}, Port: 3}
+	now := time.Now()
+	s := Sender{}
+
+	m, ok := s.Next([]peers.Peer{a, b}, now)
+	assert.True(t, ok)
+	assert.Equal(t, Message{Added: []peers.Peer{a, b}, AddedFlags: []byte{FlagReachable, FlagReachable}}, m)
+
+	// rate limited
+	_, ok = s.Next([]peers.Peer{a, b, c}, now.Add(Interval/2))
+	assert.False(t, ok)
+
+	m, ok = s.Next([]peers.Peer{b, c}, now.Add(Interval))
+	assert.True(t, ok)
+	assert.Equal(t, Message{Added: []peers.Peer{c}, AddedFlags: []byte{FlagReachable}, Dropped: []peers.Peer{a}}, m)
+
+	// nothing changed
+	_, ok = s.Next([]peers.Peer{b, c}, now.Add(2*Interval))
+	assert.False(t, ok)
+}
+
+func TestSenderLimit(t *testing.T) {
+	var connected []peers.Peer
+	for i := range MaxPeers + 10 {
+		connected = append(connected, peers.Peer{IP: net.IP{10, 0, 0, byte(i)}, Port: 6881})
+	}
+	now := time.Now()
+	s := Sender{}
+
+	m, ok := s.Next(connected, now)
+	assert.True(t, ok)
+	assert.Len(t, m.Added, MaxPeers)
+
+	// the rest goes out with the next message
+	m, ok = s.Next(connected, now.Add(Interval))
+	assert.True(t, ok)
+	assert.Len(t, m.Added, 10)
+	for i, peer := range m.Added {
+		assert.Equal(t, "10.0.0."+strconv.Itoa(MaxPeers+i)+":6881", peer.String())
+	}
+}
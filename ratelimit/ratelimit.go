@@ -0,0 +1,173 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket holding up to a second's worth of bytes. A nil
+// Limiter or one with a rate of 0 does not limit.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// New returns a limiter allowing rate bytes per second.
+func New(rate int) *Limiter {
+	return &Limiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (l *Limiter) Rate() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.rate)
+}
+
+// SetRate changes the limit, taking effect for the bytes that follow.
+func (l *Limiter) SetRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = float64(rate)
+	l.tokens = math.Min(l.tokens, l.rate)
+}
+
+func (l *Limiter) refill(now time.Time) {
+	l.tokens = math.Min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
+
+// reserve takes n bytes from the bucket, going into debt if it holds fewer,
+// and returns how long to wait for the debt to be paid off.
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// WaitN blocks until n bytes may pass every limiter.
+func WaitN(n int, limiters ...*Limiter) {
+	time.Sleep(reserveAll(n, limiters))
+}
+
+// reserveAll reserves n bytes from every limiter and returns how long to wait
+// for the slowest.
+func reserveAll(n int, limiters []*Limiter) time.Duration {
+	var wait time.Duration
+	for _, l := range limiters {
+		if d := l.reserve(n); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+type conn struct {
+	net.Conn
+	download []*Limiter
+	upload   []*Limiter
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// NewConn throttles reads from c by the download limiters and writes by the
+// upload limiters. Deadlines are pushed back by the time spent waiting for the
+// limiters, so throttling alone does not time the connection out.
+func NewConn(c net.Conn, download, upload []*Limiter) net.Conn {
+	return &conn{Conn: c, download: download, upload: upload}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if wait := reserveAll(n, c.download); wait > 0 {
+		c.mu.Lock()
+		if !c.readDeadline.IsZero() {
+			c.readDeadline = c.readDeadline.Add(wait)
+			c.Conn.SetReadDeadline(c.readDeadline)
+		}
+		c.mu.Unlock()
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	if wait := reserveAll(len(p), c.upload); wait > 0 {
+		c.mu.Lock()
+		if !c.writeDeadline.IsZero() {
+			c.writeDeadline = c.writeDeadline.Add(wait)
+			c.Conn.SetWriteDeadline(c.writeDeadline)
+		}
+		c.mu.Unlock()
+		time.Sleep(wait)
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// ParseRate parses a rate in bytes per second with an optional k, M or G
+// suffix for binary multiples, such as 512k. 0 means unlimited.
+func ParseRate(s string) (int, error) {
+	number := s
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(s, "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		number = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int(n * float64(multiplier)), nil
+}
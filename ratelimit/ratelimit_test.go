@@ -0,0 +1,149 @@
+package ratelimit
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output int
+		fails  bool
+	}{
+		"bytes":           {input: "1500", output: 1500},
+		"kibibytes":       {input: "512k", output: 512 << 10},
+		"mebibytes":       {input: "1.5M", output: 3 << 19},
+		"gibibytes":       {input: "1G", output: 1 << 30},
+		"unlimited":       {input: "0", output: 0},
+		"negative":        {input: "-5k", fails: true},
+		"unknown suffix":  {input: "5x", fails: true},
+		"missing numeral": {input: "k", fails: true},
+	}
+
+	for name, test := range tests {
+		rate, err := ParseRate(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, rate, name)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	l := New(1000)
+	// a full bucket lets a second's worth through at once
+	assert.Equal(t, time.Duration(0), l.reserve(1000))
+	wait := l.reserve(500)
+	assert.InDelta(t, 500*time.Millisecond, wait, float64(10*time.Millisecond))
+
+	l.SetRate(0)
+	assert.Equal(t, time.Duration(0), l.reserve(1<<20))
+
+	var unset *Limiter
+	assert.Equal(t, time.Duration(0), unset.reserve(1<<20))
+	assert.Equal(t, 0, unset.Rate())
+}
+
+func TestWaitNTakesSlowestLimiter(t *testing.T) {
+	fast := New(1 << 20)
+	slow := New(1000)
+	slow.reserve(1000)
+
+	start := time.Now()
+	WaitN(100, fast, slow, nil)
+	assert.InDelta(t, 100*time.Millisecond, time.Since(start), float64(50*time.Millisecond))
+}
+
+func TestConnThrottlesWrites(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	received := make(chan int)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		n, _ := io.Copy(io.Discard, c)
+		received <- int(n)
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	upload := New(10000)
+	throttled := NewConn(c, nil, []*Limiter{upload})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err = throttled.Write(make([]byte, 5000))
+		require.Nil(t, err)
+	}
+	throttled.Close()
+	// the first 10000 bytes fit the bucket, the rest waits half a second
+	assert.InDelta(t, 500*time.Millisecond, time.Since(start), float64(100*time.Millisecond))
+	assert.Equal(t, 15000, <-received)
+}
+
+func TestConnExtendsWriteDeadline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(io.Discard, c)
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	throttled := NewConn(c, nil, []*Limiter{New(1000)})
+	defer throttled.Close()
+
+	// the second write waits half a second, well past the deadline
+	throttled.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = throttled.Write(make([]byte, 1000))
+	require.Nil(t, err)
+	_, err = throttled.Write(make([]byte, 500))
+	assert.Nil(t, err)
+}
+
+func TestConnExtendsReadDeadline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write(make([]byte, 6000))
+		io.Copy(io.Discard, c)
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	throttled := NewConn(c, []*Limiter{New(4000)}, nil)
+	defer throttled.Close()
+
+	// the bucket covers four reads, the fifth and sixth wait a quarter of a
+	// second each, past the deadline
+	throttled.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buf := make([]byte, 1000)
+	for i := 0; i < 6; i++ {
+		_, err = io.ReadFull(throttled, buf)
+		require.Nil(t, err, "read %d", i)
+	}
+}
@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// scheduleInterval is how often Run checks which rule applies.
+const scheduleInterval = time.Minute
+
+// Rule limits the rates between From and To, times of day counted from
+// midnight. A rule whose To is before its From spans midnight.
+type Rule struct {
+	From     time.Duration
+	To       time.Duration
+	Download int
+	Upload   int
+}
+
+// Schedule sets limiter rates by time of day. The first rule covering a time
+// applies, and Download and Upload outside all of them.
+type Schedule struct {
+	Rules    []Rule
+	Download int
+	Upload   int
+}
+
+func (r Rule) covers(timeOfDay time.Duration) bool {
+	if r.From <= r.To {
+		return timeOfDay >= r.From && timeOfDay < r.To
+	}
+	return timeOfDay >= r.From || timeOfDay < r.To
+}
+
+// At returns the download and upload rates for now in its location.
+func (s Schedule) At(now time.Time) (download, upload int) {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	timeOfDay := now.Sub(midnight)
+	for _, r := range s.Rules {
+		if r.covers(timeOfDay) {
+			return r.Download, r.Upload
+		}
+	}
+	return s.Download, s.Upload
+}
+
+// Run keeps the rates of download and upload following the schedule until
+// stop is closed.
+func (s Schedule) Run(download, upload *Limiter, stop <-chan struct{}) {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		d, u := s.At(time.Now())
+		if download.Rate() != d {
+			download.SetRate(d)
+		}
+		if upload.Rate() != u {
+			upload.SetRate(u)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ParseRule parses a rule written as from-to=download/upload, such as
+// 09:00-17:00=1M/256k.
+func ParseRule(s string) (Rule, error) {
+	times, rates, ok := strings.Cut(s, "=")
+	if !ok {
+		return Rule{}, fmt.Errorf("rule %q has no rates", s)
+	}
+	from, to, ok := strings.Cut(times, "-")
+	if !ok {
+		return Rule{}, fmt.Errorf("rule %q has no time range", s)
+	}
+	download, upload, ok := strings.Cut(rates, "/")
+	if !ok {
+		return Rule{}, fmt.Errorf("rule %q needs download/upload rates", s)
+	}
+
+	var r Rule
+	var err error
+	r.From, err = parseTimeOfDay(from)
+	if err != nil {
+		return Rule{}, err
+	}
+	r.To, err = parseTimeOfDay(to)
+	if err != nil {
+		return Rule{}, err
+	}
+	r.Download, err = ParseRate(download)
+	if err != nil {
+		return Rule{}, err
+	}
+	r.Upload, err = ParseRate(upload)
+	if err != nil {
+		return Rule{}, err
+	}
+	return r, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
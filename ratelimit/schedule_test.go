@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output Rule
+		fails  bool
+	}{
+		"office hours": {
+			input:  "09:00-17:30=1M/256k",
+			output: Rule{From: 9 * time.Hour, To: 17*time.Hour + 30*time.Minute, Download: 1 << 20, Upload: 256 << 10},
+		},
+		"overnight": {
+			input:  "22:00-06:00=0/0",
+			output: Rule{From: 22 * time.Hour, To: 6 * time.Hour},
+		},
+		"missing rates": {
+			input: "09:00-17:00",
+			fails: true,
+		},
+		"missing upload rate": {
+			input: "09:00-17:00=1M",
+			fails: true,
+		},
+		"missing time range": {
+			input: "09:00=1M/1M",
+			fails: true,
+		},
+		"invalid time": {
+			input: "25:00-17:00=1M/1M",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		r, err := ParseRule(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, r, name)
+	}
+}
+
+func TestScheduleAt(t *testing.T) {
+	s := Schedule{
+		Rules: []Rule{
+			{From: 9 * time.Hour, To: 17 * time.Hour, Download: 100, Upload: 10},
+			{From: 22 * time.Hour, To: 6 * time.Hour, Download: 0, Upload: 50},
+		},
+		Download: 1000,
+		Upload:   500,
+	}
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 3, 1, hour, minute, 0, 0, time.UTC)
+	}
+	tests := map[string]struct {
+		now      time.Time
+		download int
+		upload   int
+	}{
+		"during office hours":   {now: at(12, 0), download: 100, upload: 10},
+		"rule start is covered": {now: at(9, 0), download: 100, upload: 10},
+		"rule end is not":       {now: at(17, 0), download: 1000, upload: 500},
+		"before midnight":       {now: at(23, 30), download: 0, upload: 50},
+		"after midnight":        {now: at(2, 0), download: 0, upload: 50},
+		"outside every rule":    {now: at(7, 0), download: 1000, upload: 500},
+	}
+
+	for name, test := range tests {
+		download, upload := s.At(test.now)
+		assert.Equal(t, test.download, download, name)
+		assert.Equal(t, test.upload, upload, name)
+	}
+}
+
+func TestScheduleRun(t *testing.T) {
+	s := Schedule{Download: 1000, Upload: 500}
+	download, upload := New(0), New(0)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.Run(download, upload, stop)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return download.Rate() == 1000 && upload.Rate() == 500 }, time.Second, 10*time.Millisecond)
+	close(stop)
+	<-done
+}
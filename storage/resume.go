@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"bittorrent_client/bencodeutil"
+	"bittorrent_client/bitfield"
+	"fmt"
+	"os"
+
+	"github.com/jackpal/bencode-go"
+)
+
+type bencodeResumeFile struct {
+	Length int   `bencode:"length"`
+	Mtime  int64 `bencode:"mtime"`
+}
+
+type bencodeResume struct {
+	Pieces   int                 `bencode:"pieces"`
+	Bitfield string              `bencode:"bitfield"`
+	Files    []bencodeResumeFile `bencode:"files"`
+}
+
+func (s *Storage) fileStates() ([]bencodeResumeFile, error) {
+	states := make([]bencodeResumeFile, len(s.files))
+	for i, f := range s.handles {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		states[i] = bencodeResumeFile{Length: int(info.Size()), Mtime: info.ModTime().UnixNano()}
+	}
+	return states, nil
+}
+
+// SaveResume records the completed pieces together with the current size and
+// modification time of every file, so a restart can skip the full recheck.
+func (s *Storage) SaveResume(path string, completed bitfield.BitField, numPieces int) error {
+	files, err := s.fileStates()
+	if err != nil {
+		return err
+	}
+	resume := bencodeResume{
+		Pieces:   numPieces,
+		Bitfield: string(completed),
+		Files:    files,
+	}
+	return bencodeutil.WriteFile(path, resume)
+}
+
+// LoadResume returns the completed pieces recorded at path. It fails if the
+// files on disk were replaced since the resume data was saved. Files written
+// to after the save, as by a download that did not get to save again, only
+// make the result stale: the recorded pieces still hold, but the others may
+// have arrived since and need to be rechecked.
+func (s *Storage) LoadResume(path string, numPieces int) (completed bitfield.BitField, stale bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	resume := bencodeResume{}
+	err = bencode.Unmarshal(f, &resume)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if resume.Pieces != numPieces || len(resume.Bitfield) != (numPieces+7)/8 {
+		return nil, false, fmt.Errorf("resume data is for %d pieces, expected %d", resume.Pieces, numPieces)
+	}
+	files, err := s.fileStates()
+	if err != nil {
+		return nil, false, err
+	}
+	if len(resume.Files) != len(files) {
+		return nil, false, fmt.Errorf("resume data has %d files, expected %d", len(resume.Files), len(files))
+	}
+	for i, file := range files {
+		saved := resume.Files[i]
+		if file.Length != saved.Length || file.Mtime < saved.Mtime {
+			return nil, false, fmt.Errorf("%s changed since resume data was saved", s.files[i].Path)
+		}
+		if file.Mtime > saved.Mtime {
+			stale = true
+		}
+	}
+	return bitfield.BitField(resume.Bitfield), stale, nil
+}
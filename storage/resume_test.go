@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"bittorrent_client/bitfield"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResume(t *testing.T) {
+	tests := map[string]struct {
+		modify    func(dir string)
+		numPieces int
+		output    bitfield.BitField
+		stale     bool
+		fails     bool
+	}{
+		"files unchanged": {
+			modify:    func(dir string) {},
+			numPieces: 3,
+			output:    bitfield.BitField{0b10100000},
+			fails:     false,
+		},
+		"file written to since": {
+			modify: func(dir string) {
+				future := time.Now().Add(time.Hour)
+				os.Chtimes(filepath.Join(dir, "a"), future, future)
+			},
+			numPieces: 3,
+			output:    bitfield.BitField{0b10100000},
+			stale:     true,
+			fails:     false,
+		},
+		"file replaced by an older one": {
+			modify: func(dir string) {
+				past := time.Now().Add(-time.Hour)
+				os.Chtimes(filepath.Join(dir, "a"), past, past)
+			},
+			numPieces: 3,
+			output:    nil,
+			fails:     true,
+		},
+		"file length changed": {
+			modify: func(dir string) {
+				os.Truncate(filepath.Join(dir, "a"), 1)
+			},
+			numPieces: 3,
+			output:    nil,
+			fails:     true,
+		},
+		"piece count mismatch": {
+			modify:    func(dir string) {},
+			numPieces: 12,
+			output:    nil,
+			fails:     true,
+		},
+	}
+
+	for _, test := range tests {
+		s, dir := createStorage(t)
+		resumePath := filepath.Join(dir, "out.resume")
+		err := s.SaveResume(resumePath, bitfield.BitField{0b10100000}, 3)
+		require.Nil(t, err)
+
+		test.modify(dir)
+
+		bf, stale, err := s.LoadResume(resumePath, test.numPieces)
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.output, bf)
+		assert.Equal(t, test.stale, stale)
+	}
+}
+
+func TestLoadResumeMissing(t *testing.T) {
+	s, dir := createStorage(t)
+	bf, _, err := s.LoadResume(filepath.Join(dir, "missing.resume"), 3)
+	assert.NotNil(t, err)
+	assert.Nil(t, bf)
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// File is a file on disk holding the bytes [Offset, Offset+Length) of the
+// torrent's content.
+type File struct {
+	Path   string
+	Length int
+	Offset int
+}
+
+type Storage struct {
+	files   []File
+	handles []*os.File
+	length  int
+}
+
+// New opens every file, creating missing ones along with their directories,
+// and preallocates them to their final length. A file longer than its length
+// is not the torrent's and is left alone with an error.
+func New(files []File) (*Storage, error) {
+	s := &Storage{files: files}
+	for _, file := range files {
+		err := os.MkdirAll(filepath.Dir(file.Path), 0755)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		f, err := os.OpenFile(file.Path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.handles = append(s.handles, f)
+		info, err := f.Stat()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if info.Size() > int64(file.Length) {
+			s.Close()
+			return nil, fmt.Errorf("%s is %d bytes, longer than the %d of the torrent", file.Path, info.Size(), file.Length)
+		}
+		if info.Size() < int64(file.Length) {
+			err = f.Truncate(int64(file.Length))
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+		if end := file.Offset + file.Length; end > s.length {
+			s.length = end
+		}
+	}
+	return s, nil
+}
+
+// span calls fn for every file overlapping [off, off+n) with the position
+// inside that file and the matching range of the caller's buffer.
+func (s *Storage) span(off int64, n int, fn func(f *os.File, fileOff int64, begin, end int) error) error {
+	if off < 0 || off+int64(n) > int64(s.length) {
+		return fmt.Errorf("range [%d, %d) out of bounds for length %d", off, off+int64(n), s.length)
+	}
+	for i, file := range s.files {
+		fileBegin := int64(file.Offset)
+		fileEnd := fileBegin + int64(file.Length)
+		if fileEnd <= off || fileBegin >= off+int64(n) {
+			continue
+		}
+		begin := max(fileBegin, off)
+		end := min(fileEnd, off+int64(n))
+		err := fn(s.handles[i], begin-fileBegin, int(begin-off), int(end-off))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	err := s.span(off, len(p), func(f *os.File, fileOff int64, begin, end int) error {
+		_, err := f.WriteAt(p[begin:end], fileOff)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	err := s.span(off, len(p), func(f *os.File, fileOff int64, begin, end int) error {
+		_, err := f.ReadAt(p[begin:end], fileOff)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *Storage) Close() error {
+	var firstErr error
+	for _, f := range s.handles {
+		err := f.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.handles = nil
+	return firstErr
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createStorage(t *testing.T) (*Storage, string) {
+	dir := t.TempDir()
+	s, err := New([]File{
+		{Path: filepath.Join(dir, "a"), Length: 3, Offset: 0},
+		{Path: filepath.Join(dir, "empty"), Length: 0, Offset: 3},
+		{Path: filepath.Join(dir, "sub", "b"), Length: 7, Offset: 3},
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s, dir
+}
+
+func TestNew(t *testing.T) {
+	_, dir := createStorage(t)
+	tests := map[string]int64{
+		"a":                       3,
+		"empty":                   0,
+		filepath.Join("sub", "b"): 7,
+	}
+	for name, size := range tests {
+		info, err := os.Stat(filepath.Join(dir, name))
+		require.Nil(t, err)
+		assert.Equal(t, size, info.Size())
+	}
+}
+
+func TestNewKeepsExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	short := filepath.Join(dir, "short")
+	long := filepath.Join(dir, "long")
+	require.Nil(t, os.WriteFile(short, []byte("ab"), 0644))
+	require.Nil(t, os.WriteFile(long, []byte("abcdef"), 0644))
+
+	s, err := New([]File{{Path: short, Length: 4}})
+	require.Nil(t, err)
+	s.Close()
+	data, err := os.ReadFile(short)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{'a', 'b', 0, 0}, data, "shorter files are extended")
+
+	_, err = New([]File{{Path: short, Length: 4}, {Path: long, Length: 4, Offset: 4}})
+	assert.NotNil(t, err)
+	data, err = os.ReadFile(long)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("abcdef"), data, "longer files are never truncated")
+}
+
+func TestWriteAt(t *testing.T) {
+	s, dir := createStorage(t)
+
+	n, err := s.WriteAt([]byte("2345"), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+
+	a, err := os.ReadFile(filepath.Join(dir, "a"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, '2'}, a)
+	b, err := os.ReadFile(filepath.Join(dir, "sub", "b"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte{'3', '4', '5', 0, 0, 0, 0}, b)
+}
+
+func TestReadAt(t *testing.T) {
+	s, _ := createStorage(t)
+	_, err := s.WriteAt([]byte("0123456789"), 0)
+	require.Nil(t, err)
+
+	tests := map[string]struct {
+		off    int64
+		length int
+		output []byte
+		fails  bool
+	}{
+		"within one file": {off: 4, length: 3, output: []byte("456")},
+		"across files":    {off: 1, length: 5, output: []byte("12345")},
+		"past the end":    {off: 8, length: 5, output: nil, fails: true},
+		"negative offset": {off: -1, length: 2, output: nil, fails: true},
+	}
+	for _, test := range tests {
+		buf := make([]byte, test.length)
+		_, err := s.ReadAt(buf, test.off)
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, test.output, buf)
+		}
+	}
+}
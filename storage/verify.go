@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"bittorrent_client/bitfield"
+	"bytes"
+	"crypto/sha1"
+	"os"
+)
+
+// Exists reports whether any of files is already present on disk.
+func Exists(files []File) bool {
+	for _, file := range files {
+		if _, err := os.Stat(file.Path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify hashes every piece found on disk and returns a bitfield of the pieces
+// that match their expected hash.
+func (s *Storage) Verify(pieceLength int, hashes [][20]byte) (bitfield.BitField, error) {
+	bf := make(bitfield.BitField, (len(hashes)+7)/8)
+	err := s.Recheck(bf, pieceLength, hashes)
+	if err != nil {
+		return nil, err
+	}
+	return bf, nil
+}
+
+// Recheck hashes the pieces not in completed and adds those that match their
+// expected hash to it.
+func (s *Storage) Recheck(completed bitfield.BitField, pieceLength int, hashes [][20]byte) error {
+	buf := make([]byte, pieceLength)
+	for index, hash := range hashes {
+		begin := index * pieceLength
+		end := min(begin+pieceLength, s.length)
+		if begin >= end || completed.HasPiece(index) {
+			continue
+		}
+		_, err := s.ReadAt(buf[:end-begin], int64(begin))
+		if err != nil {
+			return err
+		}
+		hashed := sha1.Sum(buf[:end-begin])
+		if bytes.Equal(hashed[:], hash[:]) {
+			completed.SetPiece(index)
+		}
+	}
+	return nil
+}
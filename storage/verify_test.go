@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"bittorrent_client/bitfield"
+	"crypto/sha1"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExists(t *testing.T) {
+	dir := t.TempDir()
+	files := []File{{Path: filepath.Join(dir, "a"), Length: 3}}
+	assert.False(t, Exists(files))
+
+	s, err := New(files)
+	require.Nil(t, err)
+	defer s.Close()
+	assert.True(t, Exists(files))
+}
+
+func TestVerify(t *testing.T) {
+	s, _ := createStorage(t)
+	_, err := s.WriteAt([]byte("0123456789"), 0)
+	require.Nil(t, err)
+
+	hashes := [][20]byte{
+		sha1.Sum([]byte("0123")),
+		sha1.Sum([]byte("xxxx")), // corrupt
+		sha1.Sum([]byte("89")),   // short last piece
+	}
+	bf, err := s.Verify(4, hashes)
+	assert.Nil(t, err)
+	assert.Equal(t, bitfield.BitField{0b10100000}, bf)
+}
+
+func TestRecheck(t *testing.T) {
+	s, _ := createStorage(t)
+	_, err := s.WriteAt([]byte("0123456789"), 0)
+	require.Nil(t, err)
+
+	hashes := [][20]byte{
+		sha1.Sum([]byte("xxxx")), // trusted without hashing
+		sha1.Sum([]byte("4567")),
+		sha1.Sum([]byte("xx")), // corrupt
+	}
+	bf := bitfield.BitField{0b10000000}
+	assert.Nil(t, s.Recheck(bf, 4, hashes))
+	assert.Equal(t, bitfield.BitField{0b11000000}, bf)
+}
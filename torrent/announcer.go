@@ -0,0 +1,168 @@
+package torrent
+
+import (
+	"bittorrent_client/p2p"
+	"bittorrent_client/peers"
+	"log"
+	"time"
+)
+
+// defaultInterval is used when a tracker does not send an interval.
+const defaultInterval = 30 * time.Minute
+
+// startRetryInterval is how soon a started announce that failed is retried.
+const startRetryInterval = time.Minute
+
+// stopTimeout bounds how long shutdown waits for the stopped announce.
+const stopTimeout = 5 * time.Second
+
+// announcer keeps the trackers informed about a running download and feeds
+// the peers they return into it.
+type announcer struct {
+	tf       TorrentFile
+	tiers    *trackerTiers
+	peerID   [20]byte
+	port     uint16
+	download *p2p.Torrent
+	interval time.Duration
+	// started is set once a tracker accepted the started event
+	started bool
+
+	completed chan struct{}
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+func newAnnouncer(tf TorrentFile, peerID [20]byte, port uint16, download *p2p.Torrent) *announcer {
+	return &announcer{
+		tf:        tf,
+		tiers:     newTrackerTiers(tf.Announce, tf.AnnounceList),
+		peerID:    peerID,
+		port:      port,
+		download:  download,
+		interval:  defaultInterval,
+		completed: make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+}
+
+func (a *announcer) announce(event string) ([]peers.Peer, error) {
+	stats := a.download.Stats()
+	params := announceParams{
+		peerID:     a.peerID,
+		port:       a.port,
+		uploaded:   stats.Uploaded,
+		downloaded: stats.Downloaded,
+		left:       stats.Left,
+		event:      event,
+	}
+	res, err := a.tf.announceToTiers(a.tiers, params)
+	if err != nil {
+		return nil, err
+	}
+	if res.warning != "" {
+		log.Println("Tracker warning:", res.warning)
+	}
+	a.interval = max(res.interval, res.minInterval)
+	if a.interval <= 0 {
+		a.interval = defaultInterval
+	}
+	return res.peers, nil
+}
+
+// start sends the started event and returns the initial peer list.
+func (a *announcer) start() ([]peers.Peer, error) {
+	ps, err := a.announce(eventStarted)
+	a.started = err == nil
+	return ps, err
+}
+
+// run re-announces every interval until stopped, passing new peers on to the
+// download. If start was not called or failed, it sends the started event
+// first, so the download need not wait for slow trackers.
+func (a *announcer) run() {
+	defer close(a.stopped)
+	delay := a.interval
+	if !a.started {
+		delay = 0
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		event := eventNone
+		if !a.started {
+			event = eventStarted
+		}
+		select {
+		case <-timer.C:
+		case <-a.completed:
+			// a download that completes before the started event got through
+			// is reported as started with nothing left
+			if a.started {
+				event = eventCompleted
+			}
+		case <-a.stop:
+			a.finish()
+			return
+		}
+
+		ps, err := a.announce(event)
+		if err != nil {
+			log.Println("Could not announce:", err)
+		} else if event == eventStarted {
+			a.started = true
+		}
+		if len(ps) > 0 {
+			select {
+			case a.download.NewPeers <- ps:
+			case <-a.stop:
+				a.finish()
+				return
+			}
+		}
+		if a.started {
+			timer.Reset(a.interval)
+		} else {
+			timer.Reset(startRetryInterval)
+		}
+	}
+}
+
+// finish sends a completed event that is still pending, then the stopped
+// event. Trackers that never saw the started event are not told anything.
+func (a *announcer) finish() {
+	if !a.started {
+		return
+	}
+	select {
+	case <-a.completed:
+		_, err := a.announce(eventCompleted)
+		if err != nil {
+			log.Println("Could not announce completion:", err)
+		}
+	default:
+	}
+	_, err := a.announce(eventStopped)
+	if err != nil {
+		log.Println("Could not announce stop:", err)
+	}
+}
+
+// complete makes the announcer send the completed event right away.
+func (a *announcer) complete() {
+	select {
+	case a.completed <- struct{}{}:
+	default:
+	}
+}
+
+// close stops re-announcing and gives the stopped announce a short time to
+// reach the tracker.
+func (a *announcer) close() {
+	close(a.stop)
+	select {
+	case <-a.stopped:
+	case <-time.After(stopTimeout):
+	}
+}
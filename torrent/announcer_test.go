@@ -0,0 +1,119 @@
+package torrent
+
+import (
+	"bittorrent_client/p2p"
+	"bittorrent_client/peers"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeHTTPTracker struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []url.Values
+}
+
+func startFakeHTTPTracker(t *testing.T, response string) *fakeHTTPTracker {
+	tracker := &fakeHTTPTracker{}
+	tracker.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tracker.mu.Lock()
+		tracker.requests = append(tracker.requests, r.URL.Query())
+		tracker.mu.Unlock()
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(tracker.Close)
+	return tracker
+}
+
+func (f *fakeHTTPTracker) events() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	events := make([]string, len(f.requests))
+	for i, req := range f.requests {
+		events[i] = req.Get("event")
+	}
+	return events
+}
+
+func TestAnnouncerLifecycle(t *testing.T) {
+	tracker := startFakeHTTPTracker(t, "d8:intervali900e5:peers6:"+string([]byte{127, 0, 0, 1, 0x1A, 0xE1})+"e")
+	tf := TorrentFile{
+		Announce:    tracker.URL,
+		PiecesHash:  [][20]byte{{}, {}},
+		PieceLength: 10,
+		Length:      15,
+	}
+	download := &p2p.Torrent{
+		PieceHashes: tf.PiecesHash,
+		PieceLength: tf.PieceLength,
+		Length:      tf.Length,
+		NewPeers:    make(chan []peers.Peer),
+	}
+	ann := newAnnouncer(tf, [20]byte{}, 6881, download)
+
+	ps, err := ann.start()
+	require.Nil(t, err)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}}, ps)
+	assert.Equal(t, 900*time.Second, ann.interval)
+
+	go ann.run()
+	ann.complete()
+	select {
+	case ps = <-download.NewPeers:
+		assert.Len(t, ps, 1)
+	case <-time.After(time.Second):
+		t.Fatal("announcer did not deliver peers")
+	}
+	ann.close()
+
+	assert.Equal(t, []string{"started", "completed", "stopped"}, tracker.events())
+	assert.Equal(t, "15", tracker.requests[0].Get("left"))
+}
+
+func TestAnnouncerStartsInBackground(t *testing.T) {
+	tracker := startFakeHTTPTracker(t, "d8:intervali900e5:peers6:"+string([]byte{127, 0, 0, 1, 0x1A, 0xE1})+"e")
+	tf := TorrentFile{Announce: tracker.URL}
+	download := &p2p.Torrent{NewPeers: make(chan []peers.Peer)}
+	ann := newAnnouncer(tf, [20]byte{}, 6881, download)
+
+	go ann.run()
+	select {
+	case ps := <-download.NewPeers:
+		assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}}, ps)
+	case <-time.After(time.Second):
+		t.Fatal("announcer did not deliver peers")
+	}
+	ann.close()
+
+	assert.Equal(t, []string{"started", "stopped"}, tracker.events())
+}
+
+func TestAnnouncerSkipsStopWithoutStart(t *testing.T) {
+	tracker := startFakeHTTPTracker(t, "d14:failure reason4:nopee")
+	tf := TorrentFile{Announce: tracker.URL}
+	ann := newAnnouncer(tf, [20]byte{}, 6881, &p2p.Torrent{NewPeers: make(chan []peers.Peer)})
+
+	go ann.run()
+	assert.Eventually(t, func() bool { return len(tracker.events()) == 1 }, time.Second, 10*time.Millisecond)
+	ann.close()
+
+	assert.Equal(t, []string{"started"}, tracker.events())
+}
+
+func TestAnnouncerRespectsMinInterval(t *testing.T) {
+	tracker := startFakeHTTPTracker(t, "d8:intervali60e12:min intervali600e5:peers0:e")
+	tf := TorrentFile{Announce: tracker.URL}
+	ann := newAnnouncer(tf, [20]byte{}, 6881, &p2p.Torrent{})
+
+	_, err := ann.start()
+	require.Nil(t, err)
+	assert.Equal(t, 600*time.Second, ann.interval)
+}
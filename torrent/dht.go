@@ -0,0 +1,69 @@
+package torrent
+
+import (
+	"bittorrent_client/dht"
+	"bittorrent_client/p2p"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dhtInterval is how often a running download asks the DHT for more peers and
+// re-announces itself there.
+const dhtInterval = 15 * time.Minute
+
+// DHTEnabled controls whether downloads and magnet links use the DHT besides
+// trackers.
+var DHTEnabled = true
+
+// openDHT starts a DHT node on Port, keeping its routing table in the user's
+// cache directory. It returns nil when the DHT is disabled or cannot start.
+func openDHT() *dht.DHT {
+	if !DHTEnabled {
+		return nil
+	}
+	var statePath string
+	cacheDir, err := os.UserCacheDir()
+	if err == nil {
+		statePath = filepath.Join(cacheDir, "bittorrent_client", "dht.dat")
+	}
+	node, err := dht.New(dht.Config{
+		Addr:           fmt.Sprintf(":%d", Port),
+		BootstrapNodes: dht.DefaultBootstrapNodes,
+		StatePath:      statePath,
+	})
+	if err != nil {
+		log.Println("Could not start DHT:", err)
+		return nil
+	}
+	return node
+}
+
+// searchDHT announces the download on the DHT every dhtInterval and passes the
+// peers it finds on, until stop is closed.
+func (tf TorrentFile) searchDHT(node *dht.DHT, download *p2p.Torrent, stop chan struct{}) {
+	err := node.Bootstrap()
+	if err != nil {
+		log.Println("Could not join the DHT:", err)
+	}
+	for {
+		ps, err := node.Announce(tf.InfoHash, Port)
+		if err != nil {
+			log.Println("DHT lookup failed:", err)
+		}
+		if len(ps) > 0 {
+			select {
+			case download.NewPeers <- ps:
+			case <-stop:
+				return
+			}
+		}
+		select {
+		case <-time.After(dhtInterval):
+		case <-stop:
+			return
+		}
+	}
+}
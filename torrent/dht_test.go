@@ -0,0 +1,55 @@
+package torrent
+
+import (
+	"bittorrent_client/dht"
+	"bittorrent_client/p2p"
+	"bittorrent_client/peers"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// keep tests off the real DHT and LAN
+	DHTEnabled = false
+	LSDEnabled = false
+	os.Exit(m.Run())
+}
+
+func TestSearchDHT(t *testing.T) {
+	infoHash := [20]byte{0xde, 0xe8, 0x6a, 0x7f}
+	router, err := dht.New(dht.Config{Addr: "127.0.0.1:0"})
+	require.Nil(t, err)
+	defer router.Close()
+	seeder, err := dht.New(dht.Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{router.Addr().String()}})
+	require.Nil(t, err)
+	defer seeder.Close()
+	require.Nil(t, seeder.Bootstrap())
+	_, err = seeder.Announce(infoHash, 51413)
+	require.Nil(t, err)
+
+	node, err := dht.New(dht.Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{router.Addr().String()}})
+	require.Nil(t, err)
+	defer node.Close()
+	tf := TorrentFile{InfoHash: infoHash}
+	download := &p2p.Torrent{NewPeers: make(chan []peers.Peer)}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tf.searchDHT(node, download, stop)
+	}()
+
+	select {
+	case ps := <-download.NewPeers:
+		assert.Contains(t, ps, peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: 51413})
+	case <-time.After(5 * time.Second):
+		t.Fatal("no peers from the DHT")
+	}
+	close(stop)
+	<-stopped
+}
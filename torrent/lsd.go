@@ -0,0 +1,56 @@
+package torrent
+
+import (
+	"bittorrent_client/lsd"
+	"bittorrent_client/p2p"
+	"log"
+	"time"
+)
+
+// LSDEnabled controls whether downloads look for peers on the local network.
+var LSDEnabled = true
+
+// openLSD joins the local service discovery group. It returns nil when LSD
+// is disabled or the group cannot be joined.
+func openLSD() *lsd.LSD {
+	if !LSDEnabled {
+		return nil
+	}
+	node, err := lsd.New(lsd.Group4, Port)
+	if err != nil {
+		log.Println("Could not start local service discovery:", err)
+		return nil
+	}
+	return node
+}
+
+// searchLSD announces the download on the LAN every lsd.AnnounceInterval and
+// passes the LAN peers that announce it on, until stop is closed.
+func (tf TorrentFile) searchLSD(node *lsd.LSD, download *p2p.Torrent, stop chan struct{}) {
+	found := node.Subscribe(tf.InfoHash)
+	defer node.Unsubscribe(tf.InfoHash)
+	ticker := time.NewTicker(lsd.AnnounceInterval)
+	defer ticker.Stop()
+
+	announce := func() {
+		err := node.Announce(tf.InfoHash)
+		if err != nil {
+			log.Println("Could not announce on the LAN:", err)
+		}
+	}
+	announce()
+	for {
+		select {
+		case ps := <-found:
+			select {
+			case download.LocalPeers <- ps:
+			case <-stop:
+				return
+			}
+		case <-ticker.C:
+			announce()
+		case <-stop:
+			return
+		}
+	}
+}
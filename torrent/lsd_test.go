@@ -0,0 +1,54 @@
+package torrent
+
+import (
+	"bittorrent_client/lsd"
+	"bittorrent_client/p2p"
+	"bittorrent_client/peers"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchLSD(t *testing.T) {
+	infoHash := [20]byte{0xde, 0xe8, 0x6a, 0x7f}
+	node, err := lsd.New("127.0.0.1:0", Port)
+	require.Nil(t, err)
+	defer node.Close()
+
+	tf := TorrentFile{InfoHash: infoHash}
+	download := &p2p.Torrent{LocalPeers: make(chan []peers.Peer)}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tf.searchLSD(node, download, stop)
+	}()
+
+	// unicast stands in for the multicast group, which is not reachable in
+	// every test environment
+	packet := "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 51413\r\n" +
+		"Infohash: dee86a7f00000000000000000000000000000000\r\n\r\n\r\n"
+	conn, err := net.DialUDP("udp", nil, node.Addr())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		_, err = conn.Write([]byte(packet))
+		require.Nil(t, err)
+		select {
+		case ps := <-download.LocalPeers:
+			assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 51413}}, ps)
+			close(stop)
+			<-stopped
+			return
+		case <-time.After(100 * time.Millisecond):
+			// the subscription may not be in place yet
+		case <-deadline:
+			t.Fatal("no LAN peer delivered")
+		}
+	}
+}
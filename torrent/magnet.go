@@ -0,0 +1,100 @@
+package torrent
+
+import (
+	"bittorrent_client/magnet"
+	"bittorrent_client/metadata"
+	"bittorrent_client/peers"
+	"bytes"
+	"crypto/rand"
+	"log"
+	"sync"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// metadataLeft is reported as bytes left while the size of the torrent is
+// still unknown, so trackers treat us as a leecher and hand out seeders.
+const metadataLeft = 16384
+
+// OpenMagnet resolves a magnet link into a TorrentFile by fetching the info
+// dictionary from the peers found through the link's trackers, its x.pe peers
+// and the DHT.
+func OpenMagnet(uri string) (TorrentFile, error) {
+	m, err := magnet.Parse(uri)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	tf := TorrentFile{InfoHash: m.InfoHash, Name: m.Name, peers: m.Peers}
+	// magnet links do not group trackers, so each one is its own tier
+	for _, tracker := range m.Trackers {
+		tf.AnnounceList = append(tf.AnnounceList, []string{tracker})
+	}
+	if len(m.Trackers) > 0 {
+		tf.Announce = m.Trackers[0]
+	}
+
+	var peerID [20]byte
+	_, err = rand.Read(peerID[:])
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	// the trackers and the DHT are asked at the same time, so an
+	// unresponsive tracker does not hold up the DHT search
+	var wg sync.WaitGroup
+	var fromTrackers, fromDHT []peers.Peer
+	if len(m.Trackers) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			params := announceParams{peerID: peerID, port: Port, left: metadataLeft}
+			res, err := tf.announceToTiers(newTrackerTiers(tf.Announce, tf.AnnounceList), params)
+			if err != nil {
+				log.Println("Could not announce:", err)
+			}
+			fromTrackers = res.peers
+		}()
+	}
+	if node := openDHT(); node != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer node.Close()
+			err := node.Bootstrap()
+			if err == nil {
+				fromDHT, err = node.GetPeers(m.InfoHash)
+			}
+			if err != nil {
+				log.Println("Could not search the DHT:", err)
+			}
+		}()
+	}
+	wg.Wait()
+	ps := append([]peers.Peer(nil), m.Peers...)
+	ps = append(ps, fromTrackers...)
+	ps = append(ps, fromDHT...)
+
+	raw, err := metadata.Fetch(ps, peerID, m.InfoHash)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	return tf.withInfo(raw)
+}
+
+// withInfo fills in the fields described by the raw info dictionary. The info
+// hash is kept rather than recomputed, since re-encoding drops keys this client
+// does not know about.
+func (tf TorrentFile) withInfo(raw []byte) (TorrentFile, error) {
+	var info bencodeInfo
+	err := bencode.Unmarshal(bytes.NewReader(raw), &info)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	full, err := info.toTorrentFile(tf.InfoHash)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	full.Announce = tf.Announce
+	full.AnnounceList = tf.AnnounceList
+	full.peers = tf.peers
+	return full, nil
+}
@@ -0,0 +1,53 @@
+package torrent
+
+import (
+	"bittorrent_client/peers"
+	"crypto/sha1"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithInfo(t *testing.T) {
+	// the private key is unknown to bencodeInfo, so the hash must not be
+	// recomputed from the decoded struct
+	raw := []byte("d6:lengthi15e4:name4:test12:piece lengthi10e6:pieces40:" +
+		"aaaaaaaaaaaaaaaaaaaabbbbbbbbbbbbbbbbbbbb7:privatei1ee")
+	magnetPeers := []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}}
+	tf := TorrentFile{
+		Announce:     "http://tracker/announce",
+		AnnounceList: [][]string{{"http://tracker/announce"}},
+		InfoHash:     sha1.Sum(raw),
+		peers:        magnetPeers,
+	}
+
+	full, err := tf.withInfo(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, TorrentFile{
+		Announce:     "http://tracker/announce",
+		AnnounceList: [][]string{{"http://tracker/announce"}},
+		InfoHash:     sha1.Sum(raw),
+		PiecesHash: [][20]byte{
+			{'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a'},
+			{'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b'},
+		},
+		PieceLength: 10,
+		Length:      15,
+		Name:        "test",
+		Files:       []File{{Path: []string{"test"}, Length: 15}},
+		peers:       magnetPeers,
+	}, full)
+
+	_, err = tf.withInfo([]byte("d4:name2:..e"))
+	assert.NotNil(t, err)
+}
+
+func TestOpenMagnetInvalid(t *testing.T) {
+	_, err := OpenMagnet("magnet:?dn=no-hash")
+	assert.NotNil(t, err)
+
+	// neither trackers nor peers to fetch the metadata from
+	_, err = OpenMagnet("magnet:?xt=urn:btih:dee86a7fa6f286a9d74c362014616a0ff5e4843d")
+	assert.NotNil(t, err)
+}
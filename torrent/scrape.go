@@ -0,0 +1,198 @@
+package torrent
+
+import (
+	"bittorrent_client/bencodeutil"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// BEP 15 caps a UDP scrape at 74 info-hashes per request.
+const maxUDPScrapeHashes = 74
+
+// ScrapeResult describes the health of one swarm.
+type ScrapeResult struct {
+	Seeders   int
+	Leechers  int
+	Completed int
+}
+
+// scrapeURL derives the scrape URL from an HTTP announce URL as described in
+// BEP 48: the last path element must start with "announce", which is replaced
+// by "scrape".
+func scrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	dir, file := path.Split(u.Path)
+	if !strings.HasPrefix(file, "announce") {
+		return "", fmt.Errorf("tracker %s does not support scrape", announce)
+	}
+	u.Path = dir + "scrape" + strings.TrimPrefix(file, "announce")
+	return u.String(), nil
+}
+
+// Scrape asks the tracker at announce about every swarm in infoHashes using as
+// few requests as the protocol allows.
+func Scrape(announce string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	if strings.HasPrefix(announce, "udp://") {
+		return scrapeUDP(announce, infoHashes)
+	}
+	return scrapeHTTP(announce, infoHashes)
+}
+
+func scrapeHTTP(announce string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	base, err := scrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	for _, infoHash := range infoHashes {
+		query.Add("info_hash", string(infoHash[:]))
+	}
+	u.RawQuery = query.Encode()
+
+	client := http.Client{Timeout: 30 * time.Second}
+	res, err := client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+		return nil, &TrackerError{Tracker: announce, StatusCode: res.StatusCode, Reason: string(body)}
+	}
+
+	// bencode.Unmarshal cannot fill maps of structs, so walk the generic form
+	decoded, err := bencode.Decode(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("scrape response is not a dictionary")
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, &TrackerError{Tracker: announce, Reason: reason}
+	}
+	files, _ := dict["files"].(map[string]interface{})
+	results := map[[20]byte]ScrapeResult{}
+	for key, value := range files {
+		stats, ok := value.(map[string]interface{})
+		if !ok || len(key) != 20 {
+			continue
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], key)
+		results[infoHash] = ScrapeResult{
+			Seeders:   bencodeutil.Int(stats["complete"]),
+			Leechers:  bencodeutil.Int(stats["incomplete"]),
+			Completed: bencodeutil.Int(stats["downloaded"]),
+		}
+	}
+	return results, nil
+}
+
+func scrapeUDP(announce string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	tracker, err := dialUDPTracker(announce)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.Close()
+
+	results := map[[20]byte]ScrapeResult{}
+	for begin := 0; begin < len(infoHashes); begin += maxUDPScrapeHashes {
+		batch := infoHashes[begin:min(begin+maxUDPScrapeHashes, len(infoHashes))]
+		stats, err := tracker.scrape(batch)
+		if err != nil {
+			return nil, err
+		}
+		for i, infoHash := range batch {
+			results[infoHash] = stats[i]
+		}
+	}
+	return results, nil
+}
+
+// ScrapeTracker asks the torrent's trackers, in announce-list order, for the
+// health of its swarm.
+func (tf TorrentFile) ScrapeTracker() (ScrapeResult, error) {
+	results, errs := ScrapeTorrents([]TorrentFile{tf})
+	return results[0], errs[0]
+}
+
+// ScrapeTorrents asks about the swarms of several torrents with one scrape
+// per tracker for all the torrents it serves. A torrent whose tracker fails
+// or does not know it moves on to its next tracker in announce-list order.
+// The i-th result or error belongs to tfs[i].
+func ScrapeTorrents(tfs []TorrentFile) ([]ScrapeResult, []error) {
+	results := make([]ScrapeResult, len(tfs))
+	errs := make([]error, len(tfs))
+	failures := make([][]error, len(tfs))
+	trackers := make([][]string, len(tfs))
+	var pending []int
+	for i, tf := range tfs {
+		for _, tier := range newTrackerTiers(tf.Announce, tf.AnnounceList).snapshot() {
+			trackers[i] = append(trackers[i], tier...)
+		}
+		pending = append(pending, i)
+	}
+
+	for len(pending) > 0 {
+		// group the torrents still waiting by the next tracker they have
+		groups := map[string][]int{}
+		var order []string
+		for _, i := range pending {
+			if len(trackers[i]) == 0 {
+				if len(failures[i]) == 0 {
+					errs[i] = fmt.Errorf("torrent has no trackers")
+				} else {
+					errs[i] = fmt.Errorf("all trackers failed: %w", errors.Join(failures[i]...))
+				}
+				continue
+			}
+			tracker := trackers[i][0]
+			trackers[i] = trackers[i][1:]
+			if _, ok := groups[tracker]; !ok {
+				order = append(order, tracker)
+			}
+			groups[tracker] = append(groups[tracker], i)
+		}
+
+		pending = nil
+		for _, tracker := range order {
+			group := groups[tracker]
+			infoHashes := make([][20]byte, len(group))
+			for j, i := range group {
+				infoHashes[j] = tfs[i].InfoHash
+			}
+			scraped, err := Scrape(tracker, infoHashes)
+			for _, i := range group {
+				result, ok := scraped[tfs[i].InfoHash]
+				switch {
+				case err != nil:
+					failures[i] = append(failures[i], fmt.Errorf("%s: %w", tracker, err))
+				case !ok:
+					failures[i] = append(failures[i], fmt.Errorf("%s: tracker does not know the torrent", tracker))
+				default:
+					results[i] = result
+					continue
+				}
+				pending = append(pending, i)
+			}
+		}
+	}
+	return results, errs
+}
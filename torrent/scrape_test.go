@@ -0,0 +1,132 @@
+package torrent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output string
+		fails  bool
+	}{
+		"plain announce":      {input: "http://example.com/announce", output: "http://example.com/scrape"},
+		"announce with query": {input: "http://example.com/x/announce?x2%0644", output: "http://example.com/x/scrape?x2%0644"},
+		"announce suffix":     {input: "http://example.com/announce.php", output: "http://example.com/scrape.php"},
+		"no announce element": {input: "http://example.com/a", fails: true},
+		"announce not last":   {input: "http://example.com/announce/x", fails: true},
+	}
+
+	for _, test := range tests {
+		u, err := scrapeURL(test.input)
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, test.output, u)
+		}
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	first := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	second := [20]byte{20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1}
+	var requested []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.Query()["info_hash"]
+		assert.Equal(t, "/scrape", r.URL.Path)
+		w.Write([]byte("d5:filesd" +
+			"20:" + string(first[:]) + "d8:completei5e10:downloadedi50e10:incompletei10ee" +
+			"20:" + string(second[:]) + "d8:completei1e10:downloadedi2e10:incompletei3ee" +
+			"ee"))
+	}))
+	defer ts.Close()
+
+	results, err := Scrape(ts.URL+"/announce", [][20]byte{first, second})
+	require.Nil(t, err)
+	assert.Equal(t, []string{string(first[:]), string(second[:])}, requested)
+	expected := map[[20]byte]ScrapeResult{
+		first:  {Seeders: 5, Leechers: 10, Completed: 50},
+		second: {Seeders: 1, Leechers: 3, Completed: 2},
+	}
+	assert.Equal(t, expected, results)
+}
+
+func TestScrapeTracker(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d5:filesd20:" + string(infoHash[:]) + "d8:completei7e10:downloadedi9e10:incompletei2eeee"))
+	}))
+	defer ts.Close()
+	tf := TorrentFile{
+		AnnounceList: [][]string{{"http://127.0.0.1:1/no-scrape"}, {ts.URL + "/announce"}},
+		InfoHash:     infoHash,
+	}
+
+	result, err := tf.ScrapeTracker()
+	assert.Nil(t, err)
+	assert.Equal(t, ScrapeResult{Seeders: 7, Leechers: 2, Completed: 9}, result)
+}
+
+func TestScrapeTorrents(t *testing.T) {
+	first := [20]byte{1}
+	second := [20]byte{2}
+	third := [20]byte{3}
+	var requests [][]string
+	var mu sync.Mutex
+	shared := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Query()["info_hash"])
+		mu.Unlock()
+		w.Write([]byte("d5:filesd" +
+			"20:" + string(first[:]) + "d8:completei1e10:downloadedi1e10:incompletei1ee" +
+			"20:" + string(second[:]) + "d8:completei2e10:downloadedi2e10:incompletei2ee" +
+			"ee"))
+	}))
+	defer shared.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d5:filesd20:" + string(third[:]) + "d8:completei3e10:downloadedi3e10:incompletei3eeee"))
+	}))
+	defer fallback.Close()
+
+	tfs := []TorrentFile{
+		{Announce: shared.URL + "/announce", InfoHash: first},
+		{Announce: shared.URL + "/announce", InfoHash: second},
+		// the shared tracker does not know it, so it goes on to the next
+		{AnnounceList: [][]string{{shared.URL + "/announce"}, {fallback.URL + "/announce"}}, InfoHash: third},
+		{InfoHash: [20]byte{4}},
+	}
+	results, errs := ScrapeTorrents(tfs)
+
+	assert.Equal(t, []ScrapeResult{
+		{Seeders: 1, Leechers: 1, Completed: 1},
+		{Seeders: 2, Leechers: 2, Completed: 2},
+		{Seeders: 3, Leechers: 3, Completed: 3},
+		{},
+	}, results)
+	assert.Nil(t, errs[0])
+	assert.Nil(t, errs[1])
+	assert.Nil(t, errs[2])
+	assert.NotNil(t, errs[3], "torrents without trackers cannot be scraped")
+	assert.Equal(t, [][]string{{string(first[:]), string(second[:]), string(third[:])}}, requests, "one scrape per tracker")
+}
+
+func TestScrapeUDPBatches(t *testing.T) {
+	shortenUDPTimeouts(t)
+	tracker := startFakeUDPTracker(t)
+	infoHashes := make([][20]byte, maxUDPScrapeHashes+1)
+	for i := range infoHashes {
+		infoHashes[i][0] = byte(i)
+	}
+
+	results, err := Scrape(tracker.URL(), infoHashes)
+	assert.Nil(t, err)
+	assert.Len(t, results, len(infoHashes))
+	assert.Equal(t, ScrapeResult{Seeders: 5, Leechers: 3, Completed: 10}, results[infoHashes[0]])
+}
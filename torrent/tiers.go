@@ -0,0 +1,78 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// trackerTiers is the BEP 12 multitracker list. Trackers are shuffled within
+// their tier once, tiers are tried in order, and a tracker that answers is
+// moved to the front of its tier so it is tried first next time.
+type trackerTiers struct {
+	mu    sync.Mutex
+	tiers [][]string
+}
+
+func newTrackerTiers(announce string, announceList [][]string) *trackerTiers {
+	tt := &trackerTiers{}
+	for _, tier := range announceList {
+		if len(tier) == 0 {
+			continue
+		}
+		shuffled := make([]string, len(tier))
+		copy(shuffled, tier)
+		rand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		tt.tiers = append(tt.tiers, shuffled)
+	}
+	if len(tt.tiers) == 0 && announce != "" {
+		tt.tiers = [][]string{{announce}}
+	}
+	return tt
+}
+
+func (tt *trackerTiers) snapshot() [][]string {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tiers := make([][]string, len(tt.tiers))
+	for i, tier := range tt.tiers {
+		tiers[i] = append([]string(nil), tier...)
+	}
+	return tiers
+}
+
+func (tt *trackerTiers) promote(tierIndex int, tracker string) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tier := tt.tiers[tierIndex]
+	for i, t := range tier {
+		if t == tracker {
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = tracker
+			return
+		}
+	}
+}
+
+// try calls fn for each tracker until one succeeds.
+func (tt *trackerTiers) try(fn func(tracker string) error) error {
+	var errs []error
+	for tierIndex, tier := range tt.snapshot() {
+		for _, tracker := range tier {
+			err := fn(tracker)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", tracker, err))
+				continue
+			}
+			tt.promote(tierIndex, tracker)
+			return nil
+		}
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("torrent has no trackers")
+	}
+	return fmt.Errorf("all trackers failed: %w", errors.Join(errs...))
+}
@@ -0,0 +1,94 @@
+package torrent
+
+import (
+	"bittorrent_client/peers"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTrackerTiers(t *testing.T) {
+	tests := map[string]struct {
+		announce     string
+		announceList [][]string
+		output       [][]string
+	}{
+		"announce only": {
+			announce: "http://a/announce",
+			output:   [][]string{{"http://a/announce"}},
+		},
+		"announce-list takes precedence": {
+			announce:     "http://a/announce",
+			announceList: [][]string{{"http://b/announce"}, {}, {"udp://c:80"}},
+			output:       [][]string{{"http://b/announce"}, {"udp://c:80"}},
+		},
+		"no trackers": {
+			output: nil,
+		},
+	}
+
+	for _, test := range tests {
+		tt := newTrackerTiers(test.announce, test.announceList)
+		assert.Equal(t, test.output, tt.tiers)
+	}
+}
+
+func TestNewTrackerTiersShufflesWithinTier(t *testing.T) {
+	tier := []string{"a", "b", "c", "d", "e", "f"}
+	tt := newTrackerTiers("", [][]string{tier, {"g"}})
+	assert.ElementsMatch(t, tier, tt.tiers[0])
+	assert.Equal(t, []string{"g"}, tt.tiers[1])
+	assert.Equal(t, []string{"a", "b", "c", "d", "e", "f"}, tier, "input must not be modified")
+}
+
+func TestTrackerTiersTry(t *testing.T) {
+	tt := &trackerTiers{tiers: [][]string{{"dead1", "dead2", "alive"}, {"backup"}}}
+	working := []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}}
+
+	var tried []string
+	var ps []peers.Peer
+	err := tt.try(func(tracker string) error {
+		tried = append(tried, tracker)
+		if tracker == "alive" {
+			ps = working
+			return nil
+		}
+		return fmt.Errorf("unreachable")
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, working, ps)
+	assert.Equal(t, []string{"dead1", "dead2", "alive"}, tried)
+	assert.Equal(t, [][]string{{"alive", "dead1", "dead2"}, {"backup"}}, tt.tiers)
+}
+
+func TestTrackerTiersTryFailsOverTiers(t *testing.T) {
+	tt := &trackerTiers{tiers: [][]string{{"dead1"}, {"dead2", "backup"}}}
+
+	var tried []string
+	err := tt.try(func(tracker string) error {
+		tried = append(tried, tracker)
+		if tracker == "backup" {
+			return nil
+		}
+		return fmt.Errorf("unreachable")
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dead1", "dead2", "backup"}, tried)
+	assert.Equal(t, [][]string{{"dead1"}, {"backup", "dead2"}}, tt.tiers)
+}
+
+func TestTrackerTiersTryAllFail(t *testing.T) {
+	tests := map[string]*trackerTiers{
+		"every tracker fails": {tiers: [][]string{{"dead1"}, {"dead2"}}},
+		"no trackers":         {},
+	}
+
+	for _, tt := range tests {
+		err := tt.try(func(tracker string) error {
+			return fmt.Errorf("unreachable")
+		})
+		assert.NotNil(t, err)
+	}
+}
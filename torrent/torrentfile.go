@@ -1,65 +1,138 @@
 package torrent
 
 import (
+	"bittorrent_client/bitfield"
+	"bittorrent_client/client"
 	"bittorrent_client/p2p"
+	"bittorrent_client/peers"
+	"bittorrent_client/ratelimit"
+	"bittorrent_client/storage"
 	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/jackpal/bencode-go"
 )
 
 const Port uint16 = 6881 // Default port for BitTorrent
 
+// SeedRatio and SeedTime bound how long a finished download keeps uploading:
+// until it uploaded SeedRatio times its size or SeedTime passed, whichever
+// comes first. A zero value disables that limit; both zero disables seeding.
+var (
+	SeedRatio = 1.0
+	SeedTime  = time.Hour
+)
+
+// DownloadLimit and UploadLimit throttle all downloads together. Their rates
+// may be changed at any time, and Schedule, when set, changes them by time of
+// day while downloads run.
+var (
+	DownloadLimit = ratelimit.New(0)
+	UploadLimit   = ratelimit.New(0)
+	Schedule      *ratelimit.Schedule
+)
+
+// MaxConnections caps the peer connections of each download and
+// GlobalConnections those of all downloads together.
+var (
+	MaxConnections    = 50
+	GlobalConnections = p2p.NewConnLimit(200)
+)
+
+// Bans holds the peers banned by any download, which stay banned for the rest
+// of the session.
+var Bans = p2p.NewBanList()
+
+// Stop ends every download and seed when closed. DownloadTorrent then tells
+// the trackers we left and returns nil.
+var Stop = make(chan struct{})
+
 type TorrentFile struct {
-	Announce    string
-	InfoHash    [20]byte
-	PiecesHash  [][20]byte
-	PieceLength int
-	Length      int
-	Name        string
+	Announce     string
+	AnnounceList [][]string
+	InfoHash     [20]byte
+	PiecesHash   [][20]byte
+	PieceLength  int
+	Length       int
+	Name         string
+	Files        []File
+	// DownloadLimit and UploadLimit optionally throttle this torrent on top
+	// of the global limits
+	DownloadLimit *ratelimit.Limiter
+	UploadLimit   *ratelimit.Limiter
+
+	// peers known without asking a tracker, such as a magnet link's x.pe
+	peers []peers.Peer
+}
+
+// File is one entry of the torrent's content. Path starts with the torrent
+// name, and Offset is the position of the file's first byte in the
+// concatenation of all files.
+type File struct {
+	Path   []string
+	Length int
+	Offset int
+}
+
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
 }
 
 type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length,omitempty"`
+	Files       []bencodeFile `bencode:"files,omitempty"`
+	Name        string        `bencode:"name"`
 }
 
 type bencodeTorrent struct {
-	Info     bencodeInfo `bencode:"info"`
-	Announce string      `bencode:"announce"`
+	Info         bencodeInfo `bencode:"info"`
+	Announce     string      `bencode:"announce"`
+	AnnounceList [][]string  `bencode:"announce-list"`
+}
+
+func (bto bencodeTorrent) toTorrentFile(infoHash [20]byte) (TorrentFile, error) {
+	tf, err := bto.Info.toTorrentFile(infoHash)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	tf.Announce = bto.Announce
+	tf.AnnounceList = bto.AnnounceList
+	return tf, nil
 }
 
-func (bto bencodeTorrent) toTorrentFile() (TorrentFile, error) {
+func (info bencodeInfo) toTorrentFile(infoHash [20]byte) (TorrentFile, error) {
 	var tf TorrentFile
 	var err error
-	tf.Announce = bto.Announce
-	tf.PieceLength = bto.Info.PieceLength
-	tf.Length = bto.Info.Length
-	tf.Name = bto.Info.Name
-	tf.InfoHash, err = bto.Info.hash()
+	if info.PieceLength <= 0 {
+		return TorrentFile{}, fmt.Errorf("invalid piece length %d", info.PieceLength)
+	}
+	tf.InfoHash = infoHash
+	tf.PieceLength = info.PieceLength
+	tf.Name = info.Name
+	tf.Files, tf.Length, err = info.splitFiles()
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	tf.PiecesHash, err = bto.Info.splitPieceHashes()
+	tf.PiecesHash, err = info.splitPieceHashes()
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	return tf, nil
-}
-
-func (info bencodeInfo) hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, info)
-	if err != nil {
-		return [20]byte{}, err
+	numPieces := (tf.Length + tf.PieceLength - 1) / tf.PieceLength
+	if len(tf.PiecesHash) != numPieces {
+		return TorrentFile{}, fmt.Errorf("%d bytes take %d pieces, got %d piece hashes", tf.Length, numPieces, len(tf.PiecesHash))
 	}
-	hashed := sha1.Sum(buf.Bytes())
-	return hashed, nil
+	return tf, nil
 }
 
 func (info bencodeInfo) splitPieceHashes() ([][20]byte, error) {
@@ -77,58 +150,291 @@ func (info bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 	return piecedHashes, nil
 }
 
+func (info bencodeInfo) splitFiles() ([]File, int, error) {
+	if err := validatePathElement(info.Name); err != nil {
+		return nil, 0, err
+	}
+	if len(info.Files) == 0 {
+		return []File{{Path: []string{info.Name}, Length: info.Length}}, info.Length, nil
+	}
+	files := make([]File, len(info.Files))
+	offset := 0
+	for i, f := range info.Files {
+		if len(f.Path) == 0 {
+			return nil, 0, fmt.Errorf("file #%d has an empty path", i)
+		}
+		for _, elem := range f.Path {
+			if err := validatePathElement(elem); err != nil {
+				return nil, 0, err
+			}
+		}
+		if f.Length < 0 {
+			return nil, 0, fmt.Errorf("file #%d has negative length %d", i, f.Length)
+		}
+		path := append([]string{info.Name}, f.Path...)
+		files[i] = File{Path: path, Length: f.Length, Offset: offset}
+		offset += f.Length
+	}
+	return files, offset, nil
+}
+
+// validatePathElement rejects names that would escape the download directory.
+func validatePathElement(elem string) error {
+	if elem == "" || elem == "." || elem == ".." || filepath.Base(elem) != elem {
+		return fmt.Errorf("invalid path element %q", elem)
+	}
+	return nil
+}
+
 func OpenTorrent(path string) (TorrentFile, error) {
-	file, err := os.Open(path)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	defer file.Close()
 	bto := bencodeTorrent{}
-	err = bencode.Unmarshal(file, &bto)
+	err = bencode.Unmarshal(bytes.NewReader(data), &bto)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	// the info hash covers the dictionary as written, including keys this
+	// client does not know about, such as private
+	raw, err := rawInfo(data)
 	if err != nil {
 		return TorrentFile{}, err
 	}
 
-	return bto.toTorrentFile()
+	return bto.toTorrentFile(sha1.Sum(raw))
+}
+
+// rawInfo returns the bytes of the info dictionary of a bencoded torrent.
+func rawInfo(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, fmt.Errorf("torrent is not a dictionary")
+	}
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		keyEnd, err := skipValue(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		valueEnd, err := skipValue(data, keyEnd)
+		if err != nil {
+			return nil, err
+		}
+		if string(data[pos:keyEnd]) == "4:info" {
+			return data[keyEnd:valueEnd], nil
+		}
+		pos = valueEnd
+	}
+	return nil, fmt.Errorf("torrent has no info dictionary")
+}
+
+// skipValue returns the position after the bencoded value starting at pos.
+func skipValue(data []byte, pos int) (int, error) {
+	if pos >= len(data) {
+		return 0, fmt.Errorf("truncated bencode")
+	}
+	switch c := data[pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[pos:], 'e')
+		if end < 0 {
+			return 0, fmt.Errorf("unterminated integer at %d", pos)
+		}
+		return pos + end + 1, nil
+	case c == 'l' || c == 'd':
+		pos++
+		for pos < len(data) && data[pos] != 'e' {
+			var err error
+			pos, err = skipValue(data, pos)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if pos >= len(data) {
+			return 0, fmt.Errorf("truncated bencode")
+		}
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(data[pos:], ':')
+		if colon < 0 {
+			return 0, fmt.Errorf("invalid string length at %d", pos)
+		}
+		n, err := strconv.Atoi(string(data[pos : pos+colon]))
+		if err != nil {
+			return 0, fmt.Errorf("invalid string length at %d", pos)
+		}
+		end := pos + colon + 1 + n
+		if end > len(data) {
+			return 0, fmt.Errorf("truncated bencode")
+		}
+		return end, nil
+	}
+	return 0, fmt.Errorf("invalid bencode at %d", pos)
 }
 
 func (tf TorrentFile) DownloadTorrent(path string) error {
-	var peerID [20]byte
-	_, err := rand.Read(peerID[:])
+	files := tf.storageFiles(path)
+	resuming := storage.Exists(files)
+	st, err := storage.New(files)
 	if err != nil {
 		return err
 	}
-	peers, err := tf.RequestPeersFromTracker(peerID, Port)
+	defer st.Close()
+
+	resumePath := path + ".resume"
+	completed := make(bitfield.BitField, (len(tf.PiecesHash)+7)/8)
+	if resuming {
+		completed, err = tf.loadCompleted(st, resumePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	var peerID [20]byte
+	_, err = rand.Read(peerID[:])
 	if err != nil {
 		return err
 	}
 
 	tr := p2p.Torrent{
-		Peers:       peers,
 		PeerID:      peerID,
 		InfoHash:    tf.InfoHash,
 		PieceHashes: tf.PiecesHash,
 		PieceLength: tf.PieceLength,
 		Length:      tf.Length,
 		Name:        tf.Name,
+		Storage:     st,
+		Completed:   completed,
+		ResumePath:  resumePath,
+		NewPeers:    make(chan []peers.Peer),
+		LocalPeers:  make(chan []peers.Peer),
+		Incoming:    make(chan *client.Client),
+		SeedRatio:   SeedRatio,
+		SeedTime:    SeedTime,
+		// nil limiters do not limit
+		DownloadLimits: []*ratelimit.Limiter{tf.DownloadLimit, DownloadLimit},
+		UploadLimits:   []*ratelimit.Limiter{tf.UploadLimit, UploadLimit},
+		MaxConnections: MaxConnections,
+		ConnLimit:      GlobalConnections,
+		Bans:           Bans,
+		Stop:           Stop,
 	}
 
-	buf, err := tr.Download()
+	ln, err := p2p.Listen(fmt.Sprintf(":%d", Port))
 	if err != nil {
-		return err
+		log.Println("Could not accept incoming connections:", err)
+	} else {
+		defer ln.Close()
+		ln.Register(&tr)
+		defer ln.Unregister(tr.InfoHash)
+	}
+
+	node := openDHT()
+	if node != nil {
+		defer node.Close()
 	}
+	local := openLSD()
+	if local != nil {
+		defer local.Close()
+	}
+
+	ann := newAnnouncer(tf, peerID, Port, &tr)
+	tr.Peers = tf.peers
+	if len(tf.peers) == 0 && node == nil && local == nil {
+		// with no other source of peers there is nothing to do until a
+		// tracker answers; otherwise the started event is sent in the
+		// background so slow trackers do not hold up the download
+		tr.Peers, err = ann.start()
+		if err != nil {
+			return err
+		}
+	}
+	go ann.run()
+	defer ann.close()
 
-	f, err := os.Create(path)
+	if node != nil {
+		defer background(func(stop chan struct{}) { tf.searchDHT(node, &tr, stop) })()
+	}
+	if local != nil {
+		defer background(func(stop chan struct{}) { tf.searchLSD(local, &tr, stop) })()
+	}
+	if Schedule != nil {
+		defer background(func(stop chan struct{}) { Schedule.Run(DownloadLimit, UploadLimit, stop) })()
+	}
+
+	err = tr.Download()
+	if errors.Is(err, p2p.ErrStopped) {
+		tr.Close()
+		return nil
+	}
 	if err != nil {
+		tr.Close()
 		return err
 	}
+	// BEP 3 only wants completed for downloads that finished while running,
+	// not ones the resume data showed complete
+	if tr.Stats().Downloaded > 0 {
+		ann.complete()
+	}
+	tr.Seed()
+	return nil
+}
 
-	defer f.Close()
+// background runs fn in a goroutine and returns a function that closes fn's
+// stop channel and waits for fn to return.
+func background(fn func(stop chan struct{})) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		fn(stop)
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
 
-	_, err = f.Write(buf)
+// loadCompleted trusts the fast-resume file when it still matches the files on
+// disk, rechecking only the pieces it lacks when the files were written to
+// since, and falls back to rehashing every piece otherwise.
+func (tf TorrentFile) loadCompleted(st *storage.Storage, resumePath string) (bitfield.BitField, error) {
+	completed, stale, err := st.LoadResume(resumePath, len(tf.PiecesHash))
+	if err == nil && !stale {
+		return completed, nil
+	}
+	if err == nil {
+		log.Println("Rechecking pieces missing from resume data")
+		err = st.Recheck(completed, tf.PieceLength, tf.PiecesHash)
+	} else {
+		log.Println("Rechecking existing data:", err)
+		completed, err = st.Verify(tf.PieceLength, tf.PiecesHash)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
+	err = st.SaveResume(resumePath, completed, len(tf.PiecesHash))
+	if err != nil {
+		log.Println("Could not save resume data:", err)
+	}
+	return completed, nil
+}
 
-	return nil
+// filePath returns where file is stored when downloading to path. path takes
+// the place of the torrent name, so single-file torrents are written to path
+// itself and multi-file torrents use it as their root directory.
+func filePath(path string, file File) string {
+	return filepath.Join(append([]string{path}, file.Path[1:]...)...)
+}
+
+func (tf TorrentFile) storageFiles(path string) []storage.File {
+	files := make([]storage.File, len(tf.Files))
+	for i, file := range tf.Files {
+		files[i] = storage.File{
+			Path:   filePath(path, file),
+			Length: file.Length,
+			Offset: file.Offset,
+		}
+	}
+	return files
 }
@@ -1,11 +1,16 @@
 package torrent
 
 import (
+	"bittorrent_client/storage"
+	"bytes"
+	"crypto/sha1"
 	"encoding/json"
 	"flag"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/jackpal/bencode-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -45,23 +50,110 @@ func TestToTorrentFile(t *testing.T) {
 				Info: bencodeInfo{
 					Pieces:      "1234567890abcdefghijabcdefghij1234567890",
 					PieceLength: 262144,
-					Length:      351272960,
+					Length:      351272,
 					Name:        "debian-10.2.0-amd64-netinst.iso",
 				},
 			},
 			output: TorrentFile{
 				Announce: "http://bttracker.debian.org:6969/announce",
-				InfoHash: [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+				InfoHash: [20]byte{153, 195, 29, 83, 107, 107, 132, 18, 21, 177, 178, 26, 8, 30, 77, 54, 172, 8, 186, 129},
 				PiecesHash: [][20]byte{
 					{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
 					{97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 49, 50, 51, 52, 53, 54, 55, 56, 57, 48},
 				},
 				PieceLength: 262144,
-				Length:      351272960,
+				Length:      351272,
 				Name:        "debian-10.2.0-amd64-netinst.iso",
+				Files: []File{
+					{Path: []string{"debian-10.2.0-amd64-netinst.iso"}, Length: 351272, Offset: 0},
+				},
+			},
+			fails: false,
+		},
+		"multi-file conversion": {
+			input: &bencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				Info: bencodeInfo{
+					Pieces:      "1234567890abcdefghij",
+					PieceLength: 262144,
+					Files: []bencodeFile{
+						{Length: 100, Path: []string{"README"}},
+						{Length: 200, Path: []string{"sub", "data.bin"}},
+					},
+					Name: "bundle",
+				},
+			},
+			output: TorrentFile{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				InfoHash: [20]byte{84, 75, 206, 168, 122, 31, 27, 100, 145, 123, 27, 132, 65, 115, 25, 1, 133, 250, 232, 115},
+				PiecesHash: [][20]byte{
+					{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
+				},
+				PieceLength: 262144,
+				Length:      300,
+				Name:        "bundle",
+				Files: []File{
+					{Path: []string{"bundle", "README"}, Length: 100, Offset: 0},
+					{Path: []string{"bundle", "sub", "data.bin"}, Length: 200, Offset: 100},
+				},
 			},
 			fails: false,
 		},
+		"path escapes download directory": {
+			input: &bencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				Info: bencodeInfo{
+					Pieces:      "1234567890abcdefghij",
+					PieceLength: 262144,
+					Files: []bencodeFile{
+						{Length: 100, Path: []string{"..", "evil"}},
+					},
+					Name: "bundle",
+				},
+			},
+			output: TorrentFile{},
+			fails:  true,
+		},
+		"zero piece length": {
+			input: &bencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				Info: bencodeInfo{
+					Pieces: "1234567890abcdefghij",
+					Length: 100,
+					Name:   "debian-10.2.0-amd64-netinst.iso",
+				},
+			},
+			output: TorrentFile{},
+			fails:  true,
+		},
+		"too few piece hashes": {
+			input: &bencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				Info: bencodeInfo{
+					Pieces:      "1234567890abcdefghij",
+					PieceLength: 262144,
+					Length:      351272960,
+					Name:        "debian-10.2.0-amd64-netinst.iso",
+				},
+			},
+			output: TorrentFile{},
+			fails:  true,
+		},
+		"too many piece hashes": {
+			input: &bencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				Info: bencodeInfo{
+					Pieces:      "1234567890abcdefghijabcdefghij1234567890",
+					PieceLength: 262144,
+					Files: []bencodeFile{
+						{Length: 100, Path: []string{"README"}},
+					},
+					Name: "bundle",
+				},
+			},
+			output: TorrentFile{},
+			fails:  true,
+		},
 		"not enough bytes in pieces": {
 			input: &bencodeTorrent{
 				Announce: "http://bttracker.debian.org:6969/announce",
@@ -78,7 +170,9 @@ func TestToTorrentFile(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		to, err := test.input.toTorrentFile()
+		var raw bytes.Buffer
+		require.Nil(t, bencode.Marshal(&raw, test.input.Info))
+		to, err := test.input.toTorrentFile(sha1.Sum(raw.Bytes()))
 		if test.fails {
 			assert.NotNil(t, err)
 		} else {
@@ -87,3 +181,66 @@ func TestToTorrentFile(t *testing.T) {
 		assert.Equal(t, test.output, to)
 	}
 }
+
+func TestRawInfo(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output string
+		fails  bool
+	}{
+		"unknown keys are kept": {
+			input:  "d8:announce3:url4:infod6:lengthi5e4:name1:a7:privatei1e6:source3:abcee",
+			output: "d6:lengthi5e4:name1:a7:privatei1e6:source3:abce",
+		},
+		"info after nested values": {
+			input:  "d13:announce-listll1:aee4:infod4:name1:bee",
+			output: "d4:name1:be",
+		},
+		"no info": {
+			input: "d8:announce3:urle",
+			fails: true,
+		},
+		"truncated info": {
+			input: "d4:infod4:name5:ae",
+			fails: true,
+		},
+		"not a dictionary": {
+			input: "l4:infoe",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		raw, err := rawInfo([]byte(test.input))
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, string(raw), name)
+	}
+}
+
+func TestStorageFiles(t *testing.T) {
+	tf := TorrentFile{
+		Length: 10,
+		Name:   "bundle",
+		Files: []File{
+			{Path: []string{"bundle", "a"}, Length: 3, Offset: 0},
+			{Path: []string{"bundle", "sub", "b"}, Length: 7, Offset: 3},
+		},
+	}
+	expected := []storage.File{
+		{Path: filepath.Join("out", "a"), Length: 3, Offset: 0},
+		{Path: filepath.Join("out", "sub", "b"), Length: 7, Offset: 3},
+	}
+	assert.Equal(t, expected, tf.storageFiles("out"))
+
+	single := TorrentFile{
+		Length: 10,
+		Name:   "file.iso",
+		Files:  []File{{Path: []string{"file.iso"}, Length: 10, Offset: 0}},
+	}
+	expected = []storage.File{{Path: "out.iso", Length: 10, Offset: 0}}
+	assert.Equal(t, expected, single.storageFiles("out.iso"))
+}
@@ -1,55 +1,209 @@
 package torrent
 
 import (
+	"bittorrent_client/bencodeutil"
 	"bittorrent_client/peers"
+	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jackpal/bencode-go"
 )
 
-type bencodeTrackerResp struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+const (
+	eventNone      = ""
+	eventStarted   = "started"
+	eventCompleted = "completed"
+	eventStopped   = "stopped"
+)
+
+// maxErrorBody bounds how much of an unexpected HTTP response is kept.
+const maxErrorBody = 4096
+
+// trackerResp is a decoded announce response. Trackers may send peers either
+// as a compact string or as a list of dictionaries, which bencode.Unmarshal
+// cannot express, so the response is decoded by hand.
+type trackerResp struct {
+	FailureReason  string
+	WarningMessage string
+	Interval       int
+	MinInterval    int
+	Peers          []peers.Peer
+}
+
+func decodeTrackerResp(r io.Reader) (trackerResp, error) {
+	decoded, err := bencode.Decode(r)
+	if err != nil {
+		return trackerResp{}, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return trackerResp{}, fmt.Errorf("tracker response is not a dictionary")
+	}
+	resp := trackerResp{
+		Interval:    bencodeutil.Int(dict["interval"]),
+		MinInterval: bencodeutil.Int(dict["min interval"]),
+	}
+	resp.FailureReason, _ = dict["failure reason"].(string)
+	resp.WarningMessage, _ = dict["warning message"].(string)
+	if resp.FailureReason != "" {
+		return resp, nil
+	}
+
+	switch ps := dict["peers"].(type) {
+	case string:
+		resp.Peers, err = peers.GetPeers([]byte(ps))
+	case []interface{}:
+		resp.Peers, err = decodeDictPeers(ps)
+	}
+	if err != nil {
+		return trackerResp{}, err
+	}
+	if ps, ok := dict["peers6"].(string); ok {
+		peers6, err := peers.GetPeers6([]byte(ps))
+		if err != nil {
+			return trackerResp{}, err
+		}
+		resp.Peers = append(resp.Peers, peers6...)
+	}
+	return resp, nil
+}
+
+// decodeDictPeers reads the original, non-compact peer list. Entries whose ip
+// is not a literal address are skipped.
+func decodeDictPeers(list []interface{}) ([]peers.Peer, error) {
+	var ps []peers.Peer
+	for _, entry := range list {
+		dict, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("received malformed peers")
+		}
+		host, _ := dict["ip"].(string)
+		ip := net.ParseIP(host)
+		port := bencodeutil.Int(dict["port"])
+		if ip == nil || port <= 0 || port > 65535 {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		ps = append(ps, peers.Peer{IP: ip, Port: uint16(port)})
+	}
+	return ps, nil
+}
+
+// TrackerError is returned when a tracker rejects an announce, either with a
+// failure reason or with a non-200 HTTP status.
+type TrackerError struct {
+	Tracker    string
+	StatusCode int
+	Reason     string
 }
 
-func (tf TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, error) {
-	base, err := url.Parse(tf.Announce)
+func (e *TrackerError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("tracker %s returned status %d: %s", e.Tracker, e.StatusCode, e.Reason)
+	}
+	return fmt.Sprintf("tracker %s failed: %s", e.Tracker, e.Reason)
+}
+
+type announceParams struct {
+	peerID     [20]byte
+	port       uint16
+	uploaded   int
+	downloaded int
+	left       int
+	event      string
+}
+
+type announceResult struct {
+	interval    time.Duration
+	minInterval time.Duration
+	peers       []peers.Peer
+	warning     string
+}
+
+func (tf TorrentFile) buildTrackerURL(announce string, params announceParams) (string, error) {
+	base, err := url.Parse(announce)
 	if err != nil {
 		return "", err
 	}
-	params := url.Values{
+	query := url.Values{
 		"info_hash":  []string{string(tf.InfoHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"peer_id":    []string{string(params.peerID[:])},
+		"port":       []string{strconv.Itoa(int(params.port))},
+		"uploaded":   []string{strconv.Itoa(params.uploaded)},
+		"downloaded": []string{strconv.Itoa(params.downloaded)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(tf.Length)},
+		"left":       []string{strconv.Itoa(params.left)},
+	}
+	if params.event != eventNone {
+		query.Set("event", params.event)
 	}
-	base.RawQuery = params.Encode()
+	base.RawQuery = query.Encode()
 	return base.String(), nil
 }
 
+// RequestPeersFromTracker announces to the torrent's trackers, failing over
+// across the tiers of the announce-list until one of them answers.
 func (tf TorrentFile) RequestPeersFromTracker(peerID [20]byte, port uint16) ([]peers.Peer, error) {
-	trackerURL, err := tf.buildTrackerURL(peerID, port)
+	params := announceParams{peerID: peerID, port: port, left: tf.Length}
+	res, err := tf.announceToTiers(newTrackerTiers(tf.Announce, tf.AnnounceList), params)
 	if err != nil {
 		return nil, err
 	}
+	if res.warning != "" {
+		log.Println("Tracker warning:", res.warning)
+	}
+	return res.peers, nil
+}
+
+func (tf TorrentFile) announceToTiers(tiers *trackerTiers, params announceParams) (announceResult, error) {
+	var res announceResult
+	err := tiers.try(func(announce string) error {
+		var err error
+		res, err = tf.announceTo(announce, params)
+		return err
+	})
+	return res, err
+}
+
+func (tf TorrentFile) announceTo(announce string, params announceParams) (announceResult, error) {
+	if strings.HasPrefix(announce, "udp://") {
+		return tf.announceToUDPTracker(announce, params)
+	}
+	trackerURL, err := tf.buildTrackerURL(announce, params)
+	if err != nil {
+		return announceResult{}, err
+	}
 	client := http.Client{Timeout: 30 * time.Second}
 	res, err := client.Get(trackerURL)
 	if err != nil {
-		return nil, err
+		return announceResult{}, err
 	}
 	defer res.Body.Close()
-	trackerRes := bencodeTrackerResp{}
-	err = bencode.Unmarshal(res.Body, &trackerRes)
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+		return announceResult{}, &TrackerError{Tracker: announce, StatusCode: res.StatusCode, Reason: string(body)}
+	}
+	trackerRes, err := decodeTrackerResp(res.Body)
 	if err != nil {
-		return nil, err
+		return announceResult{}, err
+	}
+	if trackerRes.FailureReason != "" {
+		return announceResult{}, &TrackerError{Tracker: announce, Reason: trackerRes.FailureReason}
 	}
-	peers, err := peers.GetPeers([]byte(trackerRes.Peers))
 
-	return peers, err
+	return announceResult{
+		interval:    time.Duration(trackerRes.Interval) * time.Second,
+		minInterval: time.Duration(trackerRes.MinInterval) * time.Second,
+		peers:       trackerRes.Peers,
+		warning:     trackerRes.WarningMessage,
+	}, nil
 }
@@ -2,9 +2,11 @@ package torrent
 
 import (
 	"bittorrent_client/peers"
+	"errors"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -25,7 +27,8 @@ func TestBuildTrackerURL(t *testing.T) {
 
 	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
 	const port uint16 = 6881
-	url, err := tf.buildTrackerURL(peerID, port)
+	params := announceParams{peerID: peerID, port: port, left: tf.Length}
+	url, err := tf.buildTrackerURL(tf.Announce, params)
 	expected := "http://bttracker.debian.org:6969/announce?compact=1&downloaded=0&info_hash=%D8%F79%CE%C3%28%95l%CC%5B%BF%1F%86%D9%FD%CF%DB%A8%CE%B6&left=351272960&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=6881&uploaded=0"
 
 	assert.Nil(t, err)
@@ -67,3 +70,117 @@ func TestRequestPeers(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, expected, peers)
 }
+
+func TestRequestPeersTrackerErrors(t *testing.T) {
+	tests := map[string]struct {
+		status int
+		body   string
+		output *TrackerError
+	}{
+		"failure reason": {
+			status: http.StatusOK,
+			body:   "d14:failure reason17:torrent not founde",
+			output: &TrackerError{StatusCode: 0, Reason: "torrent not found"},
+		},
+		"non-200 status": {
+			status: http.StatusForbidden,
+			body:   "private tracker",
+			output: &TrackerError{StatusCode: http.StatusForbidden, Reason: "private tracker"},
+		},
+	}
+
+	for _, test := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+		tf := TorrentFile{Announce: ts.URL, Length: 100}
+
+		ps, err := tf.RequestPeersFromTracker([20]byte{}, 6881)
+		assert.Nil(t, ps)
+		var trackerErr *TrackerError
+		if assert.True(t, errors.As(err, &trackerErr)) {
+			test.output.Tracker = ts.URL
+			assert.Equal(t, test.output, trackerErr)
+		}
+		ts.Close()
+	}
+}
+
+func TestAnnounceWarning(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d15:warning message10:slow down!8:intervali900e5:peers0:e"))
+	}))
+	defer ts.Close()
+	tf := TorrentFile{Announce: ts.URL, Length: 100}
+
+	res, err := tf.announceTo(ts.URL, announceParams{left: tf.Length})
+	assert.Nil(t, err)
+	assert.Equal(t, "slow down!", res.warning)
+	assert.Empty(t, res.peers)
+}
+
+func TestDecodeTrackerResp(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output trackerResp
+		fails  bool
+	}{
+		"compact peers": {
+			input: "d8:intervali900e5:peers6:" + string([]byte{127, 0, 0, 1, 0x1A, 0xE1}) + "e",
+			output: trackerResp{
+				Interval: 900,
+				Peers:    []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}},
+			},
+		},
+		"dictionary peers": {
+			input: "d8:intervali900e5:peersl" +
+				"d2:ip9:127.0.0.17:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti6881ee" +
+				"d2:ip11:2001:db8::14:porti6882ee" +
+				"d2:ip11:example.com4:porti6883ee" +
+				"ee",
+			output: trackerResp{
+				Interval: 900,
+				Peers: []peers.Peer{
+					{IP: net.IP{127, 0, 0, 1}, Port: 6881},
+					{IP: net.ParseIP("2001:db8::1"), Port: 6882},
+				},
+			},
+		},
+		"compact ipv4 and ipv6 peers": {
+			input: "d8:intervali900e5:peers6:" + string([]byte{127, 0, 0, 1, 0x1A, 0xE1}) +
+				"6:peers618:" + string([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1A, 0xE2}) + "e",
+			output: trackerResp{
+				Interval: 900,
+				Peers: []peers.Peer{
+					{IP: net.IP{127, 0, 0, 1}, Port: 6881},
+					{IP: net.ParseIP("2001:db8::1"), Port: 6882},
+				},
+			},
+		},
+		"failure reason": {
+			input:  "d14:failure reason6:bannede",
+			output: trackerResp{FailureReason: "banned"},
+		},
+		"malformed peers6": {
+			input:  "d8:intervali900e6:peers63:abce",
+			output: trackerResp{},
+			fails:  true,
+		},
+		"not a dictionary": {
+			input:  "i42e",
+			output: trackerResp{},
+			fails:  true,
+		},
+	}
+
+	for _, test := range tests {
+		resp, err := decodeTrackerResp(strings.NewReader(test.input))
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.output, resp)
+	}
+}
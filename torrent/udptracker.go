@@ -0,0 +1,285 @@
+package torrent
+
+import (
+	"bittorrent_client/peers"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+)
+
+const udpProtocolID uint64 = 0x41727101980
+
+// BEP 15 lets a connection ID be reused for one minute after it was received.
+const udpConnIDLifetime = time.Minute
+
+// udpTimeout and udpMaxRetries follow the BEP 15 retransmission schedule of
+// 15 * 2^n seconds, but stop at n = 2 instead of 8: the full schedule takes
+// over two hours per request, while other trackers and peer sources could be
+// tried instead. They are variables so tests can shorten them.
+var (
+	udpTimeout    = 15 * time.Second
+	udpMaxRetries = 2
+)
+
+type udpConnID struct {
+	id       uint64
+	received time.Time
+}
+
+var udpConnIDCache = struct {
+	sync.Mutex
+	ids map[string]udpConnID
+}{ids: map[string]udpConnID{}}
+
+type udpTracker struct {
+	conn *net.UDPConn
+	host string
+	url  string
+}
+
+func dialUDPTracker(announce string) (*udpTracker, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTracker{conn: conn, host: u.Host, url: announce}, nil
+}
+
+func (t *udpTracker) Close() error {
+	return t.conn.Close()
+}
+
+func newTransactionID() (uint32, error) {
+	var buf [4]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// roundTrip sends req and waits up to 15 * 2^attempt seconds for a response
+// carrying the same transaction ID. The response is returned without its
+// action and transaction ID header.
+func (t *udpTracker) roundTrip(req []byte, action uint32, transactionID uint32, attempt int) ([]byte, error) {
+	_, err := t.conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+	t.conn.SetReadDeadline(time.Now().Add(udpTimeout << attempt))
+	defer t.conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := t.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != transactionID {
+			continue // stale or unrelated datagram
+		}
+		resAction := binary.BigEndian.Uint32(buf[0:4])
+		if resAction == udpActionError {
+			return nil, &TrackerError{Tracker: t.url, Reason: string(buf[8:n])}
+		}
+		if resAction != action {
+			return nil, fmt.Errorf("expected action %d but got %d", action, resAction)
+		}
+		res := make([]byte, n-8)
+		copy(res, buf[8:n])
+		return res, nil
+	}
+}
+
+// request performs one exchange, transparently obtaining a connection ID
+// and retrying on timeouts. build receives the connection ID and transaction
+// ID and returns the datagram to send.
+func (t *udpTracker) request(action uint32, build func(connID uint64, transactionID uint32) []byte) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt <= udpMaxRetries; attempt++ {
+		var connID uint64
+		connID, err = t.connectionID()
+		if err != nil {
+			return nil, err
+		}
+		var transactionID uint32
+		transactionID, err = newTransactionID()
+		if err != nil {
+			return nil, err
+		}
+		var res []byte
+		res, err = t.roundTrip(build(connID, transactionID), action, transactionID, attempt)
+		if err == nil {
+			return res, nil
+		}
+		var trackerErr *TrackerError
+		if errors.As(err, &trackerErr) {
+			// the connection ID may have been rejected, so don't reuse it
+			t.forgetConnectionID()
+		}
+		if !isTimeout(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func (t *udpTracker) forgetConnectionID() {
+	udpConnIDCache.Lock()
+	defer udpConnIDCache.Unlock()
+	delete(udpConnIDCache.ids, t.host)
+}
+
+func (t *udpTracker) connectionID() (uint64, error) {
+	udpConnIDCache.Lock()
+	cached, ok := udpConnIDCache.ids[t.host]
+	udpConnIDCache.Unlock()
+	if ok && time.Since(cached.received) < udpConnIDLifetime {
+		return cached.id, nil
+	}
+
+	var err error
+	for attempt := 0; attempt <= udpMaxRetries; attempt++ {
+		var transactionID uint32
+		transactionID, err = newTransactionID()
+		if err != nil {
+			return 0, err
+		}
+		req := make([]byte, 16)
+		binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+		binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+		binary.BigEndian.PutUint32(req[12:16], transactionID)
+
+		var res []byte
+		res, err = t.roundTrip(req, udpActionConnect, transactionID, attempt)
+		if err == nil {
+			if len(res) < 8 {
+				return 0, fmt.Errorf("connect response too short")
+			}
+			id := binary.BigEndian.Uint64(res[0:8])
+			udpConnIDCache.Lock()
+			udpConnIDCache.ids[t.host] = udpConnID{id: id, received: time.Now()}
+			udpConnIDCache.Unlock()
+			return id, nil
+		}
+		if !isTimeout(err) {
+			return 0, err
+		}
+	}
+	return 0, err
+}
+
+// udpEvents maps announce events to their BEP 15 codes.
+var udpEvents = map[string]uint32{
+	eventNone:      0,
+	eventCompleted: 1,
+	eventStarted:   2,
+	eventStopped:   3,
+}
+
+func (t *udpTracker) announce(infoHash [20]byte, params announceParams) (announceResult, error) {
+	key, err := newTransactionID()
+	if err != nil {
+		return announceResult{}, err
+	}
+	res, err := t.request(udpActionAnnounce, func(connID uint64, transactionID uint32) []byte {
+		req := make([]byte, 98)
+		binary.BigEndian.PutUint64(req[0:8], connID)
+		binary.BigEndian.PutUint32(req[8:12], udpActionAnnounce)
+		binary.BigEndian.PutUint32(req[12:16], transactionID)
+		copy(req[16:36], infoHash[:])
+		copy(req[36:56], params.peerID[:])
+		binary.BigEndian.PutUint64(req[56:64], uint64(params.downloaded))
+		binary.BigEndian.PutUint64(req[64:72], uint64(params.left))
+		binary.BigEndian.PutUint64(req[72:80], uint64(params.uploaded))
+		binary.BigEndian.PutUint32(req[80:84], udpEvents[params.event])
+		binary.BigEndian.PutUint32(req[84:88], 0) // IP: use the sender's
+		binary.BigEndian.PutUint32(req[88:92], key)
+		binary.BigEndian.PutUint32(req[92:96], 0xffffffff) // num_want: default
+		binary.BigEndian.PutUint16(req[96:98], params.port)
+		return req
+	})
+	if err != nil {
+		return announceResult{}, err
+	}
+	// interval, leechers and seeders precede the compact peer list
+	if len(res) < 12 {
+		return announceResult{}, fmt.Errorf("announce response too short")
+	}
+	// trackers reached over IPv6 answer with 18-byte IPv6 peers
+	getPeers := peers.GetPeers
+	if addr, ok := t.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		getPeers = peers.GetPeers6
+	}
+	ps, err := getPeers(res[12:])
+	if err != nil {
+		return announceResult{}, err
+	}
+	return announceResult{
+		interval: time.Duration(binary.BigEndian.Uint32(res[0:4])) * time.Second,
+		peers:    ps,
+	}, nil
+}
+
+func (t *udpTracker) scrape(infoHashes [][20]byte) ([]ScrapeResult, error) {
+	res, err := t.request(udpActionScrape, func(connID uint64, transactionID uint32) []byte {
+		req := make([]byte, 16+20*len(infoHashes))
+		binary.BigEndian.PutUint64(req[0:8], connID)
+		binary.BigEndian.PutUint32(req[8:12], udpActionScrape)
+		binary.BigEndian.PutUint32(req[12:16], transactionID)
+		for i, infoHash := range infoHashes {
+			copy(req[16+20*i:], infoHash[:])
+		}
+		return req
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) != 12*len(infoHashes) {
+		return nil, fmt.Errorf("expected %d scrape entries but got %d bytes", len(infoHashes), len(res))
+	}
+	results := make([]ScrapeResult, len(infoHashes))
+	for i := range results {
+		entry := res[12*i:]
+		results[i] = ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(entry[0:4])),
+			Completed: int(binary.BigEndian.Uint32(entry[4:8])),
+			Leechers:  int(binary.BigEndian.Uint32(entry[8:12])),
+		}
+	}
+	return results, nil
+}
+
+func (tf TorrentFile) announceToUDPTracker(announce string, params announceParams) (announceResult, error) {
+	tracker, err := dialUDPTracker(announce)
+	if err != nil {
+		return announceResult{}, err
+	}
+	defer tracker.Close()
+	return tracker.announce(tf.InfoHash, params)
+}
@@ -0,0 +1,176 @@
+package torrent
+
+import (
+	"bittorrent_client/peers"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeUDPTracker struct {
+	conn      *net.UDPConn
+	connectID uint64
+	connects  atomic.Int32
+	announces atomic.Int32
+	// drop is the number of announce requests to ignore before answering
+	drop atomic.Int32
+}
+
+func startFakeUDPTracker(t *testing.T) *fakeUDPTracker {
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	conn, err := net.ListenUDP("udp", addr)
+	require.Nil(t, err)
+	tracker := &fakeUDPTracker{conn: conn, connectID: 0xdeadbeefcafe}
+	t.Cleanup(func() { conn.Close() })
+	go tracker.serve()
+	return tracker
+}
+
+func (f *fakeUDPTracker) URL() string {
+	return "udp://" + f.conn.LocalAddr().String() + "/announce"
+}
+
+func (f *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+		transactionID := binary.BigEndian.Uint32(req[12:16])
+		res := make([]byte, 8)
+		binary.BigEndian.PutUint32(res[4:8], transactionID)
+
+		switch binary.BigEndian.Uint32(req[8:12]) {
+		case udpActionConnect:
+			f.connects.Add(1)
+			binary.BigEndian.PutUint32(res[0:4], udpActionConnect)
+			res = binary.BigEndian.AppendUint64(res, f.connectID)
+		case udpActionAnnounce:
+			f.announces.Add(1)
+			if f.drop.Load() > 0 {
+				f.drop.Add(-1)
+				continue
+			}
+			if binary.BigEndian.Uint64(req[0:8]) != f.connectID {
+				binary.BigEndian.PutUint32(res[0:4], udpActionError)
+				res = append(res, "bad connection id"...)
+				break
+			}
+			binary.BigEndian.PutUint32(res[0:4], udpActionAnnounce)
+			res = binary.BigEndian.AppendUint32(res, 900) // interval
+			res = binary.BigEndian.AppendUint32(res, 1)   // leechers
+			res = binary.BigEndian.AppendUint32(res, 2)   // seeders
+			res = append(res, 192, 0, 2, 123, 0x1A, 0xE1, 127, 0, 0, 1, 0x1A, 0xE9)
+		case udpActionScrape:
+			binary.BigEndian.PutUint32(res[0:4], udpActionScrape)
+			for i := 16; i < n; i += 20 {
+				res = binary.BigEndian.AppendUint32(res, 5)  // seeders
+				res = binary.BigEndian.AppendUint32(res, 10) // completed
+				res = binary.BigEndian.AppendUint32(res, 3)  // leechers
+			}
+		}
+		f.conn.WriteToUDP(res, from)
+	}
+}
+
+func shortenUDPTimeouts(t *testing.T) {
+	timeout, retries := udpTimeout, udpMaxRetries
+	udpTimeout, udpMaxRetries = 20*time.Millisecond, 2
+	t.Cleanup(func() { udpTimeout, udpMaxRetries = timeout, retries })
+}
+
+func TestRequestPeersUDP(t *testing.T) {
+	shortenUDPTimeouts(t)
+	tracker := startFakeUDPTracker(t)
+	tf := TorrentFile{
+		Announce: tracker.URL(),
+		InfoHash: [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+		Length:   351272960,
+	}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	expected := []peers.Peer{
+		{IP: net.IP{192, 0, 2, 123}, Port: 6881},
+		{IP: net.IP{127, 0, 0, 1}, Port: 6889},
+	}
+
+	ps, err := tf.RequestPeersFromTracker(peerID, 6881)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, ps)
+
+	// the connection ID is cached, so a second announce skips connecting
+	ps, err = tf.RequestPeersFromTracker(peerID, 6881)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, ps)
+	assert.Equal(t, int32(1), tracker.connects.Load())
+}
+
+func TestRequestPeersUDPRetransmits(t *testing.T) {
+	shortenUDPTimeouts(t)
+	tracker := startFakeUDPTracker(t)
+	tracker.drop.Store(2)
+	tf := TorrentFile{Announce: tracker.URL(), Length: 100}
+
+	ps, err := tf.RequestPeersFromTracker([20]byte{}, 6881)
+	assert.Nil(t, err)
+	assert.Len(t, ps, 2)
+	assert.Equal(t, int32(3), tracker.announces.Load())
+}
+
+func TestRequestPeersUDPTimeout(t *testing.T) {
+	shortenUDPTimeouts(t)
+	tracker := startFakeUDPTracker(t)
+	tracker.drop.Store(100)
+	tf := TorrentFile{Announce: tracker.URL(), Length: 100}
+
+	ps, err := tf.RequestPeersFromTracker([20]byte{}, 6881)
+	assert.NotNil(t, err)
+	assert.Nil(t, ps)
+	assert.Equal(t, int32(udpMaxRetries+1), tracker.announces.Load())
+}
+
+func TestRequestPeersUDPTrackerError(t *testing.T) {
+	shortenUDPTimeouts(t)
+	tracker := startFakeUDPTracker(t)
+	// announces carry a different ID than the tracker handed out
+	udpConnIDCache.Lock()
+	udpConnIDCache.ids[tracker.conn.LocalAddr().String()] = udpConnID{id: 2, received: time.Now()}
+	udpConnIDCache.Unlock()
+	tf := TorrentFile{Announce: tracker.URL(), Length: 100}
+
+	_, err := tf.RequestPeersFromTracker([20]byte{}, 6881)
+	var trackerErr *TrackerError
+	if assert.True(t, errors.As(err, &trackerErr)) {
+		assert.Equal(t, "bad connection id", trackerErr.Reason)
+	}
+
+	// the rejected ID is dropped, so the next announce reconnects
+	ps, err := tf.RequestPeersFromTracker([20]byte{}, 6881)
+	assert.Nil(t, err)
+	assert.Len(t, ps, 2)
+	assert.Equal(t, int32(1), tracker.connects.Load())
+}
+
+func TestScrapeUDP(t *testing.T) {
+	shortenUDPTimeouts(t)
+	tracker := startFakeUDPTracker(t)
+	conn, err := dialUDPTracker(tracker.URL())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	results, err := conn.scrape([][20]byte{{1}, {2}})
+	assert.Nil(t, err)
+	expected := []ScrapeResult{
+		{Seeders: 5, Completed: 10, Leechers: 3},
+		{Seeders: 5, Completed: 10, Leechers: 3},
+	}
+	assert.Equal(t, expected, results)
+}